@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// accountResult is the outcome of processing one account.
+type accountResult struct {
+	Name  string
+	Stats runStats
+	Code  int
+}
+
+// runAccounts processes every account in cfg.Accounts, one after the other
+// or all at once when cfg.Parallel is set, and prints a combined summary. In
+// watch mode each account is watched on its own connection until ctx is
+// cancelled. The exit code is that of the first account, in config order,
+// that failed.
+func runAccounts(ctx context.Context, cfg *Config) int {
+	results := make([]accountResult, len(cfg.Accounts))
+	states := &stateStores{}
+	for _, acct := range cfg.Accounts {
+		acct.stateStores = states
+	}
+	runAccount := func(i int) {
+		acct := cfg.Accounts[i]
+		verbose := newVerbose(acct)
+		results[i].Name = acct.Name
+		if cfg.Watch {
+			results[i].Code = runWatch(ctx, acct, verbose)
+			return
+		}
+		results[i].Stats, results[i].Code = runOnce(ctx, acct, verbose)
+		for j := range results[i].Stats.Output {
+			results[i].Stats.Output[j].Account = acct.Name
+		}
+	}
+
+	// Watching never finishes, so every account needs its own goroutine
+	if cfg.Parallel || cfg.Watch {
+		var wg sync.WaitGroup
+		for i := range cfg.Accounts {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runAccount(i)
+			}()
+		}
+		wg.Wait()
+	} else {
+		for i := range cfg.Accounts {
+			if ctx.Err() != nil {
+				break
+			}
+			runAccount(i)
+		}
+	}
+
+	if !cfg.Watch {
+		saveAccountsJSONOutput(cfg.Accounts, results)
+		if !cfg.Quiet {
+			printAccountsSummary(results, cfg.DryRun)
+		}
+	}
+
+	for _, result := range results {
+		if result.Code != exitOK {
+			return result.Code
+		}
+	}
+	return exitOK
+}
+
+// saveAccountsJSONOutput writes the JSON output of all accounts, combining
+// the output of accounts that share a json_output file.
+func saveAccountsJSONOutput(accounts []*Config, results []accountResult) {
+	var paths []string
+	outputs := make(map[string][]JSONMessageOutput)
+	for i, acct := range accounts {
+		if acct.JSONOutput == "" {
+			continue
+		}
+		if _, ok := outputs[acct.JSONOutput]; !ok {
+			paths = append(paths, acct.JSONOutput)
+		}
+		outputs[acct.JSONOutput] = append(outputs[acct.JSONOutput], results[i].Stats.Output...)
+	}
+	for _, path := range paths {
+		saveJSONOutput(path, outputs[path])
+	}
+}
+
+// printAccountsSummary prints the combined totals of all accounts followed by
+// the counts for each.
+func printAccountsSummary(results []accountResult, dryRun bool) {
+	var messages, saved int
+	for _, result := range results {
+		messages += result.Stats.Messages
+		saved += result.Stats.Saved
+	}
+
+	switch {
+	case messages == 0:
+		fmt.Println("No new messages")
+	case dryRun:
+		fmt.Printf("Dry run: would process %d message(s) and save %d file(s)\n", messages, saved)
+	default:
+		fmt.Printf("Processed %d message(s), saved %d file(s)\n", messages, saved)
+	}
+	for _, result := range results {
+		if result.Code != exitOK {
+			fmt.Printf("  %s: failed\n", result.Name)
+			continue
+		}
+		fmt.Printf("  %s: %d message(s), %d file(s)\n", result.Name, result.Stats.Messages, result.Stats.Saved)
+	}
+}
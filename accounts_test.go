@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// newTestAccount starts a test server holding one message with an image
+// attachment and returns an account config for it that saves into its own
+// output directory.
+func newTestAccount(t *testing.T, name string) *Config {
+	t.Helper()
+
+	addr, user := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+	appendTestMessage(t, user, "INBOX", testImageMessage(name+".jpg", []byte("\xff\xd8\xff\xe0"+name)))
+
+	cfg := newTestConfig(t, addr)
+	cfg.Name = name
+	cfg.Output = filepath.Join(cfg.Output, "photos")
+	cfg.Quiet = true
+	return cfg
+}
+
+func TestRunAccounts(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		t.Run("parallel="+strconv.FormatBool(parallel), func(t *testing.T) {
+			jsonPath := filepath.Join(t.TempDir(), "results.json")
+			personal := newTestAccount(t, "personal")
+			work := newTestAccount(t, "work")
+			for _, acct := range []*Config{personal, work} {
+				acct.JSONOutput = jsonPath
+			}
+
+			cfg := &Config{Quiet: true, Parallel: parallel, Accounts: []*Config{personal, work}}
+			if code := runAccounts(context.Background(), cfg); code != exitOK {
+				t.Fatalf("expected exit code %d, got %d", exitOK, code)
+			}
+
+			for _, acct := range cfg.Accounts {
+				path := filepath.Join(acct.Output, acct.Name+".jpg")
+				if _, err := os.Stat(path); err != nil {
+					t.Errorf("expected %s to be saved: %v", path, err)
+				}
+			}
+
+			data, err := os.ReadFile(jsonPath)
+			if err != nil {
+				t.Fatalf("reading JSON output: %v", err)
+			}
+			var output []JSONMessageOutput
+			if err := json.Unmarshal(data, &output); err != nil {
+				t.Fatalf("parsing JSON output: %v", err)
+			}
+			if len(output) != 2 || output[0].Account != "personal" || output[1].Account != "work" {
+				t.Errorf("expected JSON output for personal and work in config order, got %+v", output)
+			}
+		})
+	}
+}
+
+func TestRunAccounts_SharedStateFile(t *testing.T) {
+	addr, user := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+	if err := user.Create("Scans", nil); err != nil {
+		t.Fatalf("creating Scans: %v", err)
+	}
+	appendTestMessage(t, user, "INBOX", testImageMessage("inbox.jpg", []byte("\xff\xd8\xff\xe0inbox")))
+	appendTestMessage(t, user, "Scans", testImageMessage("scan.jpg", []byte("\xff\xd8\xff\xe0scan")))
+
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	var accounts []*Config
+	for _, mailbox := range []string{"INBOX", "Scans"} {
+		acct := newTestConfig(t, addr)
+		acct.Name = mailbox
+		acct.Mailbox = mailbox
+		acct.State = StateFile
+		acct.StateFile = statePath
+		acct.Quiet = true
+		accounts = append(accounts, acct)
+	}
+
+	cfg := &Config{Quiet: true, Parallel: true, Accounts: accounts}
+	if code := runAccounts(context.Background(), cfg); code != exitOK {
+		t.Fatalf("expected exit code %d, got %d", exitOK, code)
+	}
+
+	// Both accounts' messages are recorded, rather than only those of the
+	// last one to write the file
+	state, err := LoadStateStore(statePath)
+	if err != nil {
+		t.Fatalf("LoadStateStore failed: %v", err)
+	}
+	for _, mailbox := range []string{"INBOX", "Scans"} {
+		key := stateKey("user", accounts[0].Server, mailbox)
+		if mbox := state.mailboxes[key]; mbox == nil || len(mbox.UIDs) != 1 {
+			t.Errorf("expected one processed message recorded for %s, got %+v", key, mbox)
+		}
+	}
+}
+
+func TestRunAccounts_Failure(t *testing.T) {
+	ok := newTestAccount(t, "ok")
+
+	// Nothing listens on a closed listener's port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	broken := newTestAccount(t, "broken")
+	broken.Port = ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+
+	cfg := &Config{Quiet: true, Accounts: []*Config{broken, ok}}
+	if code := runAccounts(context.Background(), cfg); code != exitConnectError {
+		t.Errorf("expected exit code %d, got %d", exitConnectError, code)
+	}
+
+	// A failing account doesn't stop the others
+	if _, err := os.Stat(filepath.Join(ok.Output, "ok.jpg")); err != nil {
+		t.Errorf("expected ok.jpg to be saved: %v", err)
+	}
+}
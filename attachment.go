@@ -1,65 +1,311 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"text/template"
 )
 
+type ConflictPolicy string
+
+const (
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictSuffix    ConflictPolicy = "suffix"
+	ConflictHash      ConflictPolicy = "hash"
+)
+
+// maxSuffix bounds the search for a free "name (N).ext" filename.
+const maxSuffix = 10000
+
+// ErrFileExists is returned by SaveAttachment when the conflict policy
+// prevented the file from being written. The returned path names the existing
+// file.
+var ErrFileExists = errors.New("file already exists")
+
 // IsImageMIME returns true if the given MIME type is an image type.
 func IsImageMIME(mimeType string) bool {
 	return strings.HasPrefix(strings.ToLower(mimeType), "image/")
 }
 
-// FileWriter is an interface for writing files, allowing for testing.
+// FileWriter is the filesystem access SaveAttachment needs, allowing for
+// testing.
 type FileWriter interface {
-	WriteFile(path string, data []byte) error
+	// WriteStream creates path and copies r into it.
+	WriteStream(path string, r io.Reader) error
+	Open(path string) (io.ReadCloser, error)
+	Exists(path string) bool
+	// Rename moves a file into place, replacing any existing file.
+	Rename(oldPath, newPath string) error
+	// RenameNoReplace moves a file into place like Rename, but fails with an
+	// error matching fs.ErrExist if newPath already exists.
+	RenameNoReplace(oldPath, newPath string) error
+	Remove(path string) error
 }
 
 // OSFileWriter implements FileWriter using the real filesystem.
 type OSFileWriter struct{}
 
-func (w OSFileWriter) WriteFile(path string, data []byte) error {
-	return os.WriteFile(path, data, 0644)
+func (w OSFileWriter) WriteStream(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (w OSFileWriter) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (w OSFileWriter) Exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func (w OSFileWriter) Rename(oldPath, newPath string) error {
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// RenameNoReplace hard links the file into place and removes the old name,
+// so that a file created by another process in the meantime is never
+// replaced. On filesystems without hard links it copies into a file created
+// exclusively instead.
+func (w OSFileWriter) RenameNoReplace(oldPath, newPath string) error {
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	err := os.Link(oldPath, newPath)
+	if err == nil {
+		return os.Remove(oldPath)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	src, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+	dst, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(newPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(newPath)
+		return err
+	}
+	return os.Remove(oldPath)
+}
+
+func (w OSFileWriter) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// SaveOptions controls how SaveAttachment names and writes files.
+type SaveOptions struct {
+	// OnConflict decides what happens when the target file already exists.
+	// The zero value adds a suffix, like ConflictSuffix.
+	OnConflict ConflictPolicy
+	// Template, if set, is expanded to the path of the file relative to the
+	// output directory. Otherwise the attachment's filename is used.
+	Template *template.Template
+	// Message is the message the attachment belongs to, for use by Template.
+	Message *Message
 }
 
 // Attachment represents an email attachment.
 type Attachment struct {
 	Filename string
 	MIMEType string
-	Data     io.Reader
+	// Index is the 1-based position of the attachment within its message.
+	Index int
+	// Part is the MIME part path used to fetch the attachment's data.
+	Part []int
+	// Encoding is the part's Content-Transfer-Encoding.
+	Encoding string
+	// Size is the size of the part on the server, before its transfer
+	// encoding is decoded.
+	Size int64
+	// MaybeShown is set in dry runs on images without a filename that
+	// inline_images auto skips if the HTML body shows them, which isn't
+	// known as the body isn't fetched.
+	MaybeShown bool
+	Data       io.Reader
 }
 
 // SaveAttachment saves an attachment to the specified directory.
-// Returns the full path where the file was saved, or an error.
-func SaveAttachment(fw FileWriter, outputDir string, att Attachment) (string, error) {
-	data, err := io.ReadAll(att.Data)
+// Returns the full path where the file was saved, or an error. If the file
+// was skipped because of opts.OnConflict, it returns the existing path and
+// ErrFileExists.
+//
+// The data is streamed into a temporary file in outputDir and renamed into
+// place once complete, so a partially written attachment never appears under
+// its final name.
+func SaveAttachment(fw FileWriter, outputDir string, att Attachment, opts SaveOptions) (string, error) {
+	tmpPath, err := tempPath(outputDir)
 	if err != nil {
 		return "", err
 	}
 
+	hasher := sha256.New()
+	if err := fw.WriteStream(tmpPath, io.TeeReader(att.Data, hasher)); err != nil {
+		_ = fw.Remove(tmpPath)
+		return "", err
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			_ = fw.Remove(tmpPath)
+		}
+	}()
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	relPath, err := attachmentPath(att, opts, hash)
+	if err != nil {
+		return "", err
+	}
+
+	for attempt := 0; ; attempt++ {
+		path, err := resolveConflict(fw, filepath.Join(outputDir, relPath), hash, opts.OnConflict)
+		if err != nil {
+			return path, err
+		}
+
+		if opts.OnConflict == ConflictOverwrite {
+			err = fw.Rename(tmpPath, path)
+		} else {
+			err = fw.RenameNoReplace(tmpPath, path)
+		}
+		if errors.Is(err, fs.ErrExist) && attempt < maxSuffix {
+			// Another account or process took the name since it was
+			// checked, so check again
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		renamed = true
+		return path, nil
+	}
+}
+
+// PlanAttachmentPath returns the path SaveAttachment would save att to,
+// without reading its data. Since the content hash isn't known, {{.Hash}}
+// expands to question marks and the hash conflict policy assumes an existing
+// file differs, as the suffix policy does.
+func PlanAttachmentPath(fw FileWriter, outputDir string, att Attachment, opts SaveOptions) (string, error) {
+	relPath, err := attachmentPath(att, opts, strings.Repeat("?", sha256.Size*2))
+	if err != nil {
+		return "", err
+	}
+
+	policy := opts.OnConflict
+	if policy == ConflictHash {
+		policy = ConflictSuffix
+	}
+	return resolveConflict(fw, filepath.Join(outputDir, relPath), "", policy)
+}
+
+// attachmentPath returns the path to save att to, relative to the output
+// directory, given the hex SHA-256 hash of its content.
+func attachmentPath(att Attachment, opts SaveOptions, hash string) (string, error) {
 	// Sanitize filename to prevent path traversal attacks
 	filename := filepath.Base(att.Filename)
 	if filename == "." || filename == "/" {
 		filename = "attachment"
 	}
 
-	path := filepath.Join(outputDir, filename)
-	if err := fw.WriteFile(path, data); err != nil {
-		return "", err
+	if opts.Template == nil {
+		return filename, nil
 	}
+	return expandOutputPath(opts.Template, newTemplateData(opts.Message, att, filename, hash))
+}
 
-	return path, nil
+// tempPath returns a unique hidden path in dir for staging a download.
+func tempPath(dir string) (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, ".mailgrab-"+hex.EncodeToString(b[:])+".tmp"), nil
 }
 
-// FilterImageAttachments returns only attachments with image MIME types.
-func FilterImageAttachments(attachments []Attachment) []Attachment {
-	var images []Attachment
-	for _, att := range attachments {
-		if IsImageMIME(att.MIMEType) {
-			images = append(images, att)
+// resolveConflict picks the path to write a file with the given content hash
+// to according to policy.
+func resolveConflict(fw FileWriter, path string, hash string, policy ConflictPolicy) (string, error) {
+	switch policy {
+	case ConflictOverwrite:
+		return path, nil
+	case ConflictSkip:
+		if fw.Exists(path) {
+			return path, ErrFileExists
+		}
+		return path, nil
+	case ConflictSuffix, ConflictHash, "":
+		ext := filepath.Ext(path)
+		base := strings.TrimSuffix(path, ext)
+		candidate := path
+		for i := 1; i <= maxSuffix; i++ {
+			if !fw.Exists(candidate) {
+				return candidate, nil
+			}
+			if policy == ConflictHash {
+				existing, err := hashFile(fw, candidate)
+				if err != nil {
+					return "", fmt.Errorf("comparing with %s: %w", candidate, err)
+				}
+				if existing == hash {
+					return candidate, ErrFileExists
+				}
+			}
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
 		}
+		return "", fmt.Errorf("no free filename for %s", path)
+	default:
+		return "", fmt.Errorf("invalid conflict policy: %s", policy)
+	}
+}
+
+// hashFile returns the hex SHA-256 of an existing file.
+func hashFile(fw FileWriter, path string) (string, error) {
+	f, err := fw.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
 	}
-	return images
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestIsImageMIME(t *testing.T) {
@@ -36,63 +40,59 @@ func TestIsImageMIME(t *testing.T) {
 	}
 }
 
-func TestFilterImageAttachments(t *testing.T) {
-	attachments := []Attachment{
-		{Filename: "photo.jpg", MIMEType: "image/jpeg", Data: bytes.NewReader(nil)},
-		{Filename: "document.pdf", MIMEType: "application/pdf", Data: bytes.NewReader(nil)},
-		{Filename: "screenshot.png", MIMEType: "image/png", Data: bytes.NewReader(nil)},
-		{Filename: "notes.txt", MIMEType: "text/plain", Data: bytes.NewReader(nil)},
-		{Filename: "icon.gif", MIMEType: "image/gif", Data: bytes.NewReader(nil)},
-	}
-
-	images := FilterImageAttachments(attachments)
+// MockFileWriter is a test implementation of FileWriter
+type MockFileWriter struct {
+	WrittenFiles map[string][]byte
+	Err          error
+}
 
-	if len(images) != 3 {
-		t.Errorf("expected 3 images, got %d", len(images))
+func (m *MockFileWriter) WriteStream(path string, r io.Reader) error {
+	if m.Err != nil {
+		return m.Err
 	}
-
-	expected := map[string]bool{"photo.jpg": true, "screenshot.png": true, "icon.gif": true}
-	for _, img := range images {
-		if !expected[img.Filename] {
-			t.Errorf("unexpected image in result: %s", img.Filename)
-		}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
 	}
+	if m.WrittenFiles == nil {
+		m.WrittenFiles = make(map[string][]byte)
+	}
+	m.WrittenFiles[path] = data
+	return nil
 }
 
-func TestFilterImageAttachments_Empty(t *testing.T) {
-	var attachments []Attachment
-	images := FilterImageAttachments(attachments)
-	if images != nil {
-		t.Errorf("expected nil, got %v", images)
+func (m *MockFileWriter) Open(path string) (io.ReadCloser, error) {
+	data, ok := m.WrittenFiles[path]
+	if !ok {
+		return nil, os.ErrNotExist
 	}
+	return io.NopCloser(bytes.NewReader(data)), nil
 }
 
-func TestFilterImageAttachments_NoImages(t *testing.T) {
-	attachments := []Attachment{
-		{Filename: "document.pdf", MIMEType: "application/pdf", Data: bytes.NewReader(nil)},
-		{Filename: "notes.txt", MIMEType: "text/plain", Data: bytes.NewReader(nil)},
-	}
+func (m *MockFileWriter) Exists(path string) bool {
+	_, ok := m.WrittenFiles[path]
+	return ok
+}
 
-	images := FilterImageAttachments(attachments)
-	if images != nil {
-		t.Errorf("expected nil, got %v", images)
+func (m *MockFileWriter) Rename(oldPath, newPath string) error {
+	data, ok := m.WrittenFiles[oldPath]
+	if !ok {
+		return os.ErrNotExist
 	}
+	delete(m.WrittenFiles, oldPath)
+	m.WrittenFiles[newPath] = data
+	return nil
 }
 
-// MockFileWriter is a test implementation of FileWriter
-type MockFileWriter struct {
-	WrittenFiles map[string][]byte
-	Err          error
+func (m *MockFileWriter) RenameNoReplace(oldPath, newPath string) error {
+	if m.Exists(newPath) {
+		return os.ErrExist
+	}
+	return m.Rename(oldPath, newPath)
 }
 
-func (m *MockFileWriter) WriteFile(path string, data []byte) error {
-	if m.Err != nil {
-		return m.Err
-	}
-	if m.WrittenFiles == nil {
-		m.WrittenFiles = make(map[string][]byte)
-	}
-	m.WrittenFiles[path] = data
+func (m *MockFileWriter) Remove(path string) error {
+	delete(m.WrittenFiles, path)
 	return nil
 }
 
@@ -105,7 +105,7 @@ func TestSaveAttachment(t *testing.T) {
 		Data:     bytes.NewReader([]byte("fake image data")),
 	}
 
-	path, err := SaveAttachment(mockWriter, outputDir, att)
+	path, err := SaveAttachment(mockWriter, outputDir, att, SaveOptions{})
 	if err != nil {
 		t.Fatalf("SaveAttachment failed: %v", err)
 	}
@@ -135,7 +135,7 @@ func TestSaveAttachment_RealFS(t *testing.T) {
 		Data:     bytes.NewReader([]byte("real fake image data")),
 	}
 
-	path, err := SaveAttachment(fw, tmpDir, att)
+	path, err := SaveAttachment(fw, tmpDir, att, SaveOptions{})
 	if err != nil {
 		t.Fatalf("SaveAttachment failed: %v", err)
 	}
@@ -178,7 +178,7 @@ func TestSaveAttachment_PathTraversal(t *testing.T) {
 				Data:     bytes.NewReader([]byte("data")),
 			}
 
-			path, err := SaveAttachment(mockWriter, outputDir, att)
+			path, err := SaveAttachment(mockWriter, outputDir, att, SaveOptions{})
 			if err != nil {
 				t.Fatalf("SaveAttachment failed: %v", err)
 			}
@@ -190,3 +190,210 @@ func TestSaveAttachment_PathTraversal(t *testing.T) {
 		})
 	}
 }
+
+func TestSaveAttachment_OnConflict(t *testing.T) {
+	outputDir := "/tmp/test"
+	existing := filepath.Join(outputDir, "IMG_0001.jpg")
+
+	tests := []struct {
+		name     string
+		policy   ConflictPolicy
+		data     string
+		wantPath string
+		wantSkip bool
+	}{
+		{"overwrite", ConflictOverwrite, "new", existing, false},
+		{"default adds a suffix", "", "new", filepath.Join(outputDir, "IMG_0001 (2).jpg"), false},
+		{"skip", ConflictSkip, "new", existing, true},
+		{"suffix", ConflictSuffix, "new", filepath.Join(outputDir, "IMG_0001 (2).jpg"), false},
+		{"hash identical", ConflictHash, "old", existing, true},
+		{"hash identical to suffixed copy", ConflictHash, "older", filepath.Join(outputDir, "IMG_0001 (1).jpg"), true},
+		{"hash different", ConflictHash, "new", filepath.Join(outputDir, "IMG_0001 (2).jpg"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockWriter := &MockFileWriter{WrittenFiles: map[string][]byte{
+				existing: []byte("old"),
+				filepath.Join(outputDir, "IMG_0001 (1).jpg"): []byte("older"),
+			}}
+			att := Attachment{
+				Filename: "IMG_0001.jpg",
+				MIMEType: "image/jpeg",
+				Data:     bytes.NewReader([]byte(tt.data)),
+			}
+
+			path, err := SaveAttachment(mockWriter, outputDir, att, SaveOptions{OnConflict: tt.policy})
+			if tt.wantSkip {
+				if !errors.Is(err, ErrFileExists) {
+					t.Fatalf("expected ErrFileExists, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("SaveAttachment failed: %v", err)
+			}
+
+			if path != tt.wantPath {
+				t.Errorf("expected path %q, got %q", tt.wantPath, path)
+			}
+			if !tt.wantSkip && string(mockWriter.WrittenFiles[path]) != tt.data {
+				t.Errorf("expected %q written to %q, got %q", tt.data, path, mockWriter.WrittenFiles[path])
+			}
+			if tt.wantSkip && string(mockWriter.WrittenFiles[existing]) != "old" {
+				t.Errorf("existing file was modified")
+			}
+		})
+	}
+}
+
+func TestPlanAttachmentPath(t *testing.T) {
+	outputDir := "/tmp/test"
+	existing := filepath.Join(outputDir, "IMG_0001.jpg")
+	mockWriter := &MockFileWriter{WrittenFiles: map[string][]byte{existing: []byte("old")}}
+	att := Attachment{Filename: "IMG_0001.jpg", MIMEType: "image/jpeg"}
+
+	tests := []struct {
+		policy   ConflictPolicy
+		wantPath string
+		wantSkip bool
+	}{
+		{ConflictOverwrite, existing, false},
+		{ConflictSkip, existing, true},
+		{ConflictSuffix, filepath.Join(outputDir, "IMG_0001 (1).jpg"), false},
+		{ConflictHash, filepath.Join(outputDir, "IMG_0001 (1).jpg"), false},
+	}
+	for _, tt := range tests {
+		path, err := PlanAttachmentPath(mockWriter, outputDir, att, SaveOptions{OnConflict: tt.policy})
+		if tt.wantSkip {
+			if !errors.Is(err, ErrFileExists) {
+				t.Errorf("%s: expected ErrFileExists, got %v", tt.policy, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: PlanAttachmentPath failed: %v", tt.policy, err)
+		}
+		if path != tt.wantPath {
+			t.Errorf("%s: expected path %q, got %q", tt.policy, tt.wantPath, path)
+		}
+	}
+	if len(mockWriter.WrittenFiles) != 1 {
+		t.Errorf("expected no files to be written, got %v", mockWriter.WrittenFiles)
+	}
+
+	tmpl, err := ParseOutputTemplate("{{.Hash}}/{{.Filename}}")
+	if err != nil {
+		t.Fatalf("ParseOutputTemplate failed: %v", err)
+	}
+	path, err := PlanAttachmentPath(mockWriter, outputDir, att, SaveOptions{Template: tmpl})
+	if err != nil {
+		t.Fatalf("PlanAttachmentPath with template failed: %v", err)
+	}
+	if want := filepath.Join(outputDir, strings.Repeat("?", 64), "IMG_0001.jpg"); path != want {
+		t.Errorf("expected path %q, got %q", want, path)
+	}
+}
+
+func TestSaveAttachment_InvalidConflictPolicy(t *testing.T) {
+	att := Attachment{
+		Filename: "photo.jpg",
+		MIMEType: "image/jpeg",
+		Data:     bytes.NewReader([]byte("data")),
+	}
+	if _, err := SaveAttachment(&MockFileWriter{}, "/tmp/test", att, SaveOptions{OnConflict: "rename"}); err == nil {
+		t.Error("expected error for invalid conflict policy, got nil")
+	}
+}
+
+func TestSaveAttachment_ReadErrorLeavesNoFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	att := Attachment{
+		Filename: "broken.jpg",
+		MIMEType: "image/jpeg",
+		Data:     io.MultiReader(bytes.NewReader([]byte("partial")), iotest.ErrReader(errors.New("connection reset"))),
+	}
+
+	if _, err := SaveAttachment(OSFileWriter{}, tmpDir, att, SaveOptions{}); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("reading output directory: %v", err)
+	}
+	for _, e := range entries {
+		t.Errorf("unexpected file left behind: %s", e.Name())
+	}
+}
+
+func TestSaveAttachment_SkipRemovesTempFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	existing := filepath.Join(tmpDir, "photo.jpg")
+	if err := os.WriteFile(existing, []byte("old"), 0644); err != nil {
+		t.Fatalf("writing existing file: %v", err)
+	}
+
+	att := Attachment{
+		Filename: "photo.jpg",
+		MIMEType: "image/jpeg",
+		Data:     bytes.NewReader([]byte("new")),
+	}
+	if _, err := SaveAttachment(OSFileWriter{}, tmpDir, att, SaveOptions{OnConflict: ConflictSkip}); !errors.Is(err, ErrFileExists) {
+		t.Fatalf("expected ErrFileExists, got %v", err)
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("reading output directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "photo.jpg" {
+		t.Errorf("expected only photo.jpg in output directory, got %v", entries)
+	}
+}
+
+// racingFileWriter creates a file at the target path just before the first
+// rename, as another process saving the same filename would.
+type racingFileWriter struct {
+	OSFileWriter
+	raced bool
+}
+
+func (w *racingFileWriter) RenameNoReplace(oldPath, newPath string) error {
+	if !w.raced {
+		w.raced = true
+		if err := os.WriteFile(newPath, []byte("other"), 0644); err != nil {
+			return err
+		}
+	}
+	return w.OSFileWriter.RenameNoReplace(oldPath, newPath)
+}
+
+func TestSaveAttachment_ConcurrentWriter(t *testing.T) {
+	tests := []struct {
+		policy   ConflictPolicy
+		wantPath string
+		wantErr  error
+	}{
+		{ConflictSuffix, "photo (1).jpg", nil},
+		{ConflictHash, "photo (1).jpg", nil},
+		{ConflictSkip, "photo.jpg", ErrFileExists},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			tmpDir := t.TempDir()
+			att := Attachment{Filename: "photo.jpg", MIMEType: "image/jpeg", Data: bytes.NewReader([]byte("new"))}
+
+			path, err := SaveAttachment(&racingFileWriter{}, tmpDir, att, SaveOptions{OnConflict: tt.policy})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if want := filepath.Join(tmpDir, tt.wantPath); path != want {
+				t.Errorf("expected path %q, got %q", want, path)
+			}
+
+			// The other writer's file is never replaced
+			data, err := os.ReadFile(filepath.Join(tmpDir, "photo.jpg"))
+			if err != nil || string(data) != "other" {
+				t.Errorf("expected the other writer's file to be kept, got %q, %v", data, err)
+			}
+		})
+	}
+}
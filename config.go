@@ -3,8 +3,13 @@ package main
 import (
 	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	"gopkg.in/yaml.v3"
@@ -19,42 +24,339 @@ const (
 )
 
 type Config struct {
-	Config     string     `short:"c" long:"config" description:"Path to config file" env:"MAILGRAB_CONFIG"`
-	Server     string     `short:"s" long:"server" description:"IMAP server hostname" env:"MAILGRAB_SERVER" yaml:"server" required:"true"`
-	Port       int        `short:"p" long:"port" description:"IMAP port" env:"MAILGRAB_PORT" yaml:"port" default:"993"`
-	Username   string     `short:"u" long:"username" description:"IMAP username" env:"MAILGRAB_USERNAME" yaml:"username" required:"true"`
-	Password   string     `short:"P" long:"password" description:"IMAP password" env:"MAILGRAB_PASSWORD" yaml:"password" required:"true"`
-	Mailbox    string     `short:"m" long:"mailbox" description:"Mailbox to check" env:"MAILGRAB_MAILBOX" yaml:"mailbox" default:"Inbox"`
-	Output     string     `short:"o" long:"output" description:"Output directory for attachments" env:"MAILGRAB_OUTPUT" yaml:"output" required:"true"`
-	PostAction PostAction `long:"post-action" description:"Action after processing: none, delete, move" env:"MAILGRAB_POST_ACTION" yaml:"post_action" default:"none"`
-	MoveTo     string     `long:"move-to" description:"Target folder for move action" env:"MAILGRAB_MOVE_TO" yaml:"move_to"`
-	Insecure   bool       `long:"insecure" description:"Disable TLS verification" env:"MAILGRAB_INSECURE" yaml:"insecure"`
-	Verbose    bool       `short:"v" long:"verbose" description:"Enable verbose output" env:"MAILGRAB_VERBOSE" yaml:"verbose"`
-	Quiet      bool       `short:"q" long:"quiet" description:"Suppress non-error output" env:"MAILGRAB_QUIET" yaml:"quiet"`
-	JSONOutput string     `short:"j" long:"json-output" description:"Path to JSON output file" env:"MAILGRAB_JSON_OUTPUT" yaml:"json_output"`
+	Config             string            `short:"c" long:"config" description:"Path to config file" env:"MAILGRAB_CONFIG"`
+	Profile            string            `long:"profile" description:"Use the named entry of profiles from the config file" env:"MAILGRAB_PROFILE" yaml:"-"`
+	Server             string            `short:"s" long:"server" description:"IMAP server hostname" env:"MAILGRAB_SERVER" yaml:"server"`
+	Port               int               `short:"p" long:"port" description:"IMAP port (default: 993 for tls, 143 otherwise)" env:"MAILGRAB_PORT" yaml:"port"`
+	Security           SecurityMode      `long:"security" description:"Connection security: tls, starttls, none (default: tls)" env:"MAILGRAB_SECURITY" yaml:"security"`
+	AllowPlaintext     bool              `long:"allow-plaintext" description:"Allow security none for servers other than localhost" env:"MAILGRAB_ALLOW_PLAINTEXT" yaml:"allow_plaintext"`
+	Username           string            `short:"u" long:"username" description:"IMAP username" env:"MAILGRAB_USERNAME" yaml:"username"`
+	Password           string            `short:"P" long:"password" description:"IMAP password" env:"MAILGRAB_PASSWORD" yaml:"password" secret:"true"`
+	PasswordFile       string            `long:"password-file" description:"Read the IMAP password from the first line of a file" env:"MAILGRAB_PASSWORD_FILE" yaml:"password_file"`
+	PasswordCommand    string            `long:"password-command" description:"Run a shell command and use the first line of its output as the IMAP password" env:"MAILGRAB_PASSWORD_COMMAND" yaml:"password_command"`
+	PasswordKeyring    bool              `long:"password-keyring" description:"Read the IMAP password from the system keyring" env:"MAILGRAB_PASSWORD_KEYRING" yaml:"password_keyring"`
+	Auth               AuthMethod        `long:"auth" description:"Authentication method: password, xoauth2, oauthbearer (default: password)" env:"MAILGRAB_AUTH" yaml:"auth"`
+	OAuth2Token        string            `long:"oauth2-token" description:"OAuth2 access token" env:"MAILGRAB_OAUTH2_TOKEN" yaml:"oauth2_token" secret:"true"`
+	OAuth2TokenURL     string            `long:"oauth2-token-url" description:"OAuth2 token endpoint for refreshing access tokens" env:"MAILGRAB_OAUTH2_TOKEN_URL" yaml:"oauth2_token_url"`
+	OAuth2ClientID     string            `long:"oauth2-client-id" description:"OAuth2 client ID" env:"MAILGRAB_OAUTH2_CLIENT_ID" yaml:"oauth2_client_id"`
+	OAuth2ClientSecret string            `long:"oauth2-client-secret" description:"OAuth2 client secret" env:"MAILGRAB_OAUTH2_CLIENT_SECRET" yaml:"oauth2_client_secret" secret:"true"`
+	OAuth2RefreshToken string            `long:"oauth2-refresh-token" description:"OAuth2 refresh token" env:"MAILGRAB_OAUTH2_REFRESH_TOKEN" yaml:"oauth2_refresh_token" secret:"true"`
+	OAuth2TokenCache   string            `long:"oauth2-token-cache" description:"File to cache refreshed OAuth2 tokens in" env:"MAILGRAB_OAUTH2_TOKEN_CACHE" yaml:"oauth2_token_cache"`
+	Mailbox            string            `short:"m" long:"mailbox" description:"Mailbox to check (default: Inbox)" env:"MAILGRAB_MAILBOX" yaml:"mailbox"`
+	Mailboxes          []string          `long:"mailboxes" description:"Mailboxes or LIST patterns to check, instead of mailbox (can be repeated)" env:"MAILGRAB_MAILBOXES" env-delim:"," yaml:"mailboxes"`
+	Output             string            `short:"o" long:"output" description:"Output directory for attachments" env:"MAILGRAB_OUTPUT" yaml:"output"`
+	PostAction         PostAction        `long:"post-action" description:"Action after processing: none, delete, move (default: none)" env:"MAILGRAB_POST_ACTION" yaml:"post_action"`
+	MoveTo             string            `long:"move-to" description:"Target folder for move action" env:"MAILGRAB_MOVE_TO" yaml:"move_to"`
+	Since              string            `long:"since" description:"Only process messages received on or after a date (YYYY-MM-DD) or a time ago (7d, 2w, 36h)" env:"MAILGRAB_SINCE" yaml:"since"`
+	Before             string            `long:"before" description:"Only process messages received before a date (YYYY-MM-DD) or a time ago (7d, 2w, 36h)" env:"MAILGRAB_BEFORE" yaml:"before"`
+	SubjectContains    string            `long:"subject-contains" description:"Only process messages whose subject contains this text" env:"MAILGRAB_SUBJECT_CONTAINS" yaml:"subject_contains"`
+	LargerThan         ByteSize          `long:"larger-than" description:"Only process messages larger than this size, like 100K" env:"MAILGRAB_LARGER_THAN" yaml:"larger_than"`
+	SmallerThan        ByteSize          `long:"smaller-than" description:"Only process messages smaller than this size, like 20M" env:"MAILGRAB_SMALLER_THAN" yaml:"smaller_than"`
+	UnseenOnly         bool              `long:"unseen-only" description:"Only process messages that haven't been read" env:"MAILGRAB_UNSEEN_ONLY" yaml:"unseen_only"`
+	Headers            map[string]string `long:"header" description:"Only process messages with a header containing a value, as Name:value (can be repeated)" env:"MAILGRAB_HEADERS" env-delim:"," yaml:"headers"`
+	AllowSenders       []string          `long:"allow-senders" description:"Only process messages from these senders: addresses, @domains, or glob patterns (can be repeated)" env:"MAILGRAB_ALLOW_SENDERS" env-delim:"," yaml:"allow_senders"`
+	DenySenders        []string          `long:"deny-senders" description:"Never process messages from these senders: addresses, @domains, or glob patterns (can be repeated)" env:"MAILGRAB_DENY_SENDERS" env-delim:"," yaml:"deny_senders"`
+	RejectedAction     PostAction        `long:"rejected-action" description:"Action for messages from rejected senders: none, delete, move (default: none)" env:"MAILGRAB_REJECTED_ACTION" yaml:"rejected_action"`
+	RejectedMoveTo     string            `long:"rejected-move-to" description:"Target folder for the rejected move action" env:"MAILGRAB_REJECTED_MOVE_TO" yaml:"rejected_move_to"`
+	DryRun             bool              `long:"dry-run" description:"Show what would be saved, moved, or deleted without changing anything" env:"MAILGRAB_DRY_RUN" yaml:"-"`
+	Insecure           bool              `long:"insecure" description:"Disable TLS verification" env:"MAILGRAB_INSECURE" yaml:"insecure"`
+	TLSCAFile          string            `long:"tls-ca-file" description:"PEM file of CA certificates to verify the server with" env:"MAILGRAB_TLS_CA_FILE" yaml:"tls_ca_file"`
+	TLSCertFile        string            `long:"tls-cert-file" description:"PEM client certificate for mutual TLS" env:"MAILGRAB_TLS_CERT_FILE" yaml:"tls_cert_file"`
+	TLSKeyFile         string            `long:"tls-key-file" description:"PEM private key for the client certificate" env:"MAILGRAB_TLS_KEY_FILE" yaml:"tls_key_file"`
+	TLSServerName      string            `long:"tls-server-name" description:"Server name to verify the certificate against (default: server)" env:"MAILGRAB_TLS_SERVER_NAME" yaml:"tls_server_name"`
+	TLSMinVersion      string            `long:"tls-min-version" description:"Minimum TLS version: 1.0, 1.1, 1.2, 1.3" env:"MAILGRAB_TLS_MIN_VERSION" yaml:"tls_min_version"`
+	TLSPinSHA256       []string          `long:"tls-pin-sha256" description:"Base64 SHA-256 of the server's public key to pin (can be repeated)" env:"MAILGRAB_TLS_PIN_SHA256" env-delim:"," yaml:"tls_pin_sha256"`
+	Verbose            bool              `short:"v" long:"verbose" description:"Enable verbose output" env:"MAILGRAB_VERBOSE" yaml:"verbose"`
+	Quiet              bool              `short:"q" long:"quiet" description:"Suppress non-error output" env:"MAILGRAB_QUIET" yaml:"quiet"`
+	JSONOutput         string            `short:"j" long:"json-output" description:"Path to JSON output file" env:"MAILGRAB_JSON_OUTPUT" yaml:"json_output"`
+	Watch              bool              `short:"w" long:"watch" description:"Keep running and check for new messages periodically" env:"MAILGRAB_WATCH" yaml:"watch"`
+	Interval           time.Duration     `short:"i" long:"interval" description:"Polling interval in watch mode (default: 1m)" env:"MAILGRAB_INTERVAL" yaml:"interval"`
+	OutputTemplate     string            `short:"t" long:"output-template" description:"Template for saved file paths relative to the output directory" env:"MAILGRAB_OUTPUT_TEMPLATE" yaml:"output_template"`
+	IncludeTypes       []string          `long:"include-types" description:"Attachment types to save: MIME types, globs like image/*, or extensions like .pdf (default: image/*) (can be repeated)" env:"MAILGRAB_INCLUDE_TYPES" env-delim:"," yaml:"include_types"`
+	ExcludeTypes       []string          `long:"exclude-types" description:"Attachment types never to save, like include-types (can be repeated)" env:"MAILGRAB_EXCLUDE_TYPES" env-delim:"," yaml:"exclude_types"`
+	TypeDirs           map[string]string `long:"type-dir" description:"Save a type in a subdirectory of the output directory, as type:dir (can be repeated)" env:"MAILGRAB_TYPE_DIRS" env-delim:"," yaml:"type_dirs"`
+	TypeDetection      TypeDetection     `long:"type-detection" description:"How images are recognized: header, content, both (default: content)" env:"MAILGRAB_TYPE_DETECTION" yaml:"type_detection"`
+	InlineImages       InlineImages      `long:"inline-images" description:"Images without a filename: include, exclude, auto (default: auto)" env:"MAILGRAB_INLINE_IMAGES" yaml:"inline_images"`
+	MinBytes           ByteSize          `long:"min-bytes" description:"Skip attachments smaller than this, like 10K" env:"MAILGRAB_MIN_BYTES" yaml:"min_bytes"`
+	MaxBytes           ByteSize          `long:"max-bytes" description:"Skip attachments larger than this, like 25M" env:"MAILGRAB_MAX_BYTES" yaml:"max_bytes"`
+	MinWidth           int               `long:"min-width" description:"Skip images narrower than this many pixels" env:"MAILGRAB_MIN_WIDTH" yaml:"min_width"`
+	MinHeight          int               `long:"min-height" description:"Skip images shorter than this many pixels" env:"MAILGRAB_MIN_HEIGHT" yaml:"min_height"`
+	OnConflict         ConflictPolicy    `long:"on-conflict" description:"What to do when a file already exists: overwrite, skip, suffix, hash (default: suffix)" env:"MAILGRAB_ON_CONFLICT" yaml:"on_conflict"`
+	State              StateMode         `long:"state" description:"How processed messages are tracked: auto, keyword, file (default: auto)" env:"MAILGRAB_STATE" yaml:"state"`
+	StateFile          string            `long:"state-file" description:"Path to local state file (default: ~/.local/state/mailgrab/state.json)" env:"MAILGRAB_STATE_FILE" yaml:"state_file"`
+	NoIdle             bool              `long:"no-idle" description:"Poll instead of using IMAP IDLE in watch mode" env:"MAILGRAB_NO_IDLE" yaml:"no_idle"`
+	Account            string            `long:"account" description:"Only process the named account from accounts" env:"MAILGRAB_ACCOUNT" yaml:"-"`
+	Parallel           bool              `long:"parallel" description:"Process accounts in parallel" env:"MAILGRAB_PARALLEL" yaml:"parallel"`
+
+	// Name identifies an entry of accounts in messages and the summary.
+	Name string `no-flag:"true" yaml:"name"`
+	// Accounts are the fully resolved accounts defined in the config file,
+	// if any. The top-level settings then only serve as their defaults.
+	Accounts []*Config `no-flag:"true" yaml:"-"`
+	// Command is the subcommand given on the command line, if any.
+	Command string `no-flag:"true" yaml:"-"`
+
+	// sources records where each setting, by field name, was set
+	sources map[string]valueSource
+	// expandErr is the error from expanding environment variables in the
+	// settings of an account, reported only if the account is selected
+	expandErr error
+	// stateStores, if set, is shared with the other accounts processed
+	// together
+	stateStores *stateStores
+}
+
+// valueSource describes where the value of a setting came from.
+type valueSource string
+
+const (
+	sourceDefault valueSource = "default"
+	sourceFile    valueSource = "file"
+	sourceEnv     valueSource = "env"
+	sourceFlag    valueSource = "flag"
+)
+
+// source returns where the setting with the given field name was set.
+func (c *Config) source(field string) valueSource {
+	if src, ok := c.sources[field]; ok {
+		return src
+	}
+	return sourceDefault
+}
+
+func (c *Config) setSource(field string, src valueSource) {
+	if c.sources == nil {
+		c.sources = make(map[string]valueSource)
+	}
+	c.sources[field] = src
+}
+
+// recordFileSources marks the settings in a YAML mapping as coming from the
+// config file.
+func (c *Config) recordFileSources(node *yaml.Node) {
+	set := yamlNodeFields(node)
+	for field := range set {
+		c.setSource(field, sourceFile)
+	}
+	c.overridePasswordSource(set)
+}
+
+// yamlNodeFields returns the names of the Config fields set in a YAML
+// mapping.
+func yamlNodeFields(node *yaml.Node) map[string]bool {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	set := make(map[string]bool)
+	if node.Kind != yaml.MappingNode {
+		return set
+	}
+	fields := yamlFieldNames()
+	for i := 0; i < len(node.Content); i += 2 {
+		if field, ok := fields[node.Content[i].Value]; ok {
+			set[field] = true
+		}
+	}
+	return set
+}
+
+// recordFlagSources marks the settings given as flags or environment
+// variables in the last parse.
+func (c *Config) recordFlagSources(parser *flags.Parser) {
+	set := make(map[string]bool)
+	for _, group := range parser.Groups() {
+		for _, option := range group.Options() {
+			switch {
+			case option.IsSet() && option.IsSetDefault():
+				c.setSource(option.Field().Name, sourceEnv)
+			case option.IsSet():
+				c.setSource(option.Field().Name, sourceFlag)
+			}
+			if option.IsSet() {
+				set[option.Field().Name] = true
+			}
+		}
+	}
+	c.overridePasswordSource(set)
+}
+
+// yamlFieldNames maps config file keys to Config field names.
+func yamlFieldNames() map[string]string {
+	fields := make(map[string]string)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name != "" && name != "-" {
+			fields[name] = t.Field(i).Name
+		}
+	}
+	return fields
+}
+
+// newParser returns a command-line parser for cfg and the subcommands.
+func newParser(cfg *Config, options flags.Options) *flags.Parser {
+	parser := flags.NewParser(cfg, options)
+	parser.SubcommandsOptional = true
+	doctor, err := parser.AddCommand("doctor", "Check the configuration and the connection to the server",
+		"Print the effective configuration and where each value came from, then connect to the server and check that mailgrab can work with it.",
+		&struct{}{})
+	if err == nil {
+		doctor.Aliases = []string{"check-config"}
+	}
+	return parser
+}
+
+// logPrefix returns the prefix for output lines about this account, which is
+// empty unless the config is one of several accounts.
+func (c *Config) logPrefix() string {
+	if c.Name == "" {
+		return ""
+	}
+	return "[" + c.Name + "] "
+}
+
+// MailboxList returns the mailboxes, or LIST patterns, to check.
+func (c *Config) MailboxList() []string {
+	if len(c.Mailboxes) > 0 {
+		return c.Mailboxes
+	}
+	return []string{c.Mailbox}
 }
 
 func (c *Config) Validate() error {
+	if c.Server == "" {
+		return errors.New("server is required")
+	}
+	if c.Username == "" {
+		return errors.New("username is required")
+	}
+	if c.Output == "" {
+		return errors.New("output is required")
+	}
 	if c.PostAction == PostActionMove && c.MoveTo == "" {
 		return errors.New("move_to is required when post_action is 'move'")
 	}
+	if c.RejectedAction == PostActionMove && c.RejectedMoveTo == "" {
+		return errors.New("rejected_move_to is required when rejected_action is 'move'")
+	}
 	if c.Verbose && c.Quiet {
 		return errors.New("verbose and quiet cannot both be set")
 	}
+	if slices.Contains(c.Mailboxes, "") {
+		return errors.New("mailboxes cannot contain an empty name")
+	}
+	if c.DryRun && c.Watch {
+		return errors.New("dry-run can't be used with watch")
+	}
+	if c.Interval < 0 {
+		return errors.New("interval cannot be negative")
+	}
+	switch c.Security {
+	case SecurityTLS, SecurityStartTLS, "":
+	case SecurityNone:
+		if !c.AllowPlaintext && !isLoopbackHost(c.Server) {
+			return fmt.Errorf("security none would send credentials to %s in plaintext; use starttls or tls, or set allow_plaintext to force it", c.Server)
+		}
+	default:
+		return fmt.Errorf("invalid security: %s (must be tls, starttls, or none)", c.Security)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+	if c.TLSMinVersion != "" {
+		if _, ok := tlsVersions[c.TLSMinVersion]; !ok {
+			return fmt.Errorf("invalid tls_min_version: %s (must be 1.0, 1.1, 1.2, or 1.3)", c.TLSMinVersion)
+		}
+	}
+	if _, err := parsePins(c.TLSPinSHA256); err != nil {
+		return err
+	}
+	switch c.Auth {
+	case AuthPassword, "":
+		if c.Password == "" {
+			return errors.New("password is required (set password, password_file, password_command, or password_keyring)")
+		}
+	case AuthXOAuth2, AuthOAuthBearer:
+		if c.OAuth2Token == "" && (c.OAuth2TokenURL == "" || c.OAuth2RefreshToken == "") {
+			return fmt.Errorf("%s requires oauth2_token, or oauth2_token_url and oauth2_refresh_token", c.Auth)
+		}
+	default:
+		return fmt.Errorf("invalid auth: %s (must be password, xoauth2, or oauthbearer)", c.Auth)
+	}
 	switch c.PostAction {
 	case PostActionNone, PostActionDelete, PostActionMove, "":
 	default:
 		return fmt.Errorf("invalid post_action: %s (must be none, delete, or move)", c.PostAction)
 	}
+	switch c.RejectedAction {
+	case PostActionNone, PostActionDelete, PostActionMove, "":
+	default:
+		return fmt.Errorf("invalid rejected_action: %s (must be none, delete, or move)", c.RejectedAction)
+	}
+	if err := c.validateSearch(time.Now()); err != nil {
+		return err
+	}
+	if err := validateSenderPatterns("allow_senders", c.AllowSenders); err != nil {
+		return err
+	}
+	if err := validateSenderPatterns("deny_senders", c.DenySenders); err != nil {
+		return err
+	}
+	if err := validateTypePatterns("include_types", c.IncludeTypes); err != nil {
+		return err
+	}
+	if err := validateTypePatterns("exclude_types", c.ExcludeTypes); err != nil {
+		return err
+	}
+	if err := validateTypeDirs(c.TypeDirs); err != nil {
+		return err
+	}
+	switch c.TypeDetection {
+	case TypeDetectionHeader, TypeDetectionContent, TypeDetectionBoth, "":
+	default:
+		return fmt.Errorf("invalid type_detection: %s (must be header, content, or both)", c.TypeDetection)
+	}
+	switch c.InlineImages {
+	case InlineInclude, InlineExclude, InlineAuto, "":
+	default:
+		return fmt.Errorf("invalid inline_images: %s (must be include, exclude, or auto)", c.InlineImages)
+	}
+	if err := c.validateSizeLimits(); err != nil {
+		return err
+	}
+	switch c.State {
+	case StateAuto, StateKeyword, StateFile, "":
+	default:
+		return fmt.Errorf("invalid state: %s (must be auto, keyword, or file)", c.State)
+	}
+	if c.OutputTemplate != "" {
+		if _, err := ParseOutputTemplate(c.OutputTemplate); err != nil {
+			return err
+		}
+	}
+	switch c.OnConflict {
+	case ConflictOverwrite, ConflictSkip, ConflictSuffix, ConflictHash, "":
+	default:
+		return fmt.Errorf("invalid on_conflict: %s (must be overwrite, skip, suffix, or hash)", c.OnConflict)
+	}
 	return nil
 }
 
 func LoadConfig() (*Config, error) {
+	return loadConfig(os.Args[1:], systemKeyring())
+}
+
+// loadConfig builds the configuration from a config file, environment
+// variables and the command-line arguments args, in increasing order of
+// precedence. If the file defines accounts, each is resolved into its own
+// complete Config in cfg.Accounts. Passwords are then read from their
+// configured source, using keyring if it is the keyring.
+func loadConfig(args []string, keyring Keyring) (*Config, error) {
 	cfg := &Config{}
 
 	// First pass: parse only to get config file path (ignore errors for missing required fields)
-	parser := flags.NewParser(cfg, flags.IgnoreUnknown)
-	if _, err := parser.Parse(); err != nil {
+	parser := newParser(cfg, flags.IgnoreUnknown)
+	if _, err := parser.ParseArgs(args); err != nil {
 		// Ignore errors in first pass - we just want the config file path
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
 			os.Exit(0)
@@ -67,35 +369,162 @@ func LoadConfig() (*Config, error) {
 		return nil, err
 	}
 	if configFile != "" {
+		cfg.Config = configFile
 		if err := loadConfigFile(configFile, cfg); err != nil {
 			return nil, fmt.Errorf("loading config file: %w", err)
 		}
+	} else if cfg.Profile != "" {
+		return nil, fmt.Errorf("profile %q not found: no config file", cfg.Profile)
 	}
 
 	// Second pass: parse again with full validation
 	// Environment variables and flags will override config file values
-	parser = flags.NewParser(cfg, flags.Default)
-	if _, err := parser.Parse(); err != nil {
+	parser = newParser(cfg, flags.Default)
+	if _, err := parser.ParseArgs(args); err != nil {
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
 			os.Exit(0)
 		}
 		return nil, err
 	}
+	cfg.recordFlagSources(parser)
+	if parser.Active != nil {
+		cfg.Command = parser.Active.Name
+	}
 
-	// Set default for empty post_action
-	if cfg.PostAction == "" {
-		cfg.PostAction = PostActionNone
+	if len(cfg.Accounts) == 0 {
+		if cfg.Account != "" {
+			return nil, fmt.Errorf("account %q not found: no accounts are defined", cfg.Account)
+		}
+		cfg.applyDefaults()
+		cfg.expandPaths()
+		if err := resolvePassword(cfg, keyring); err != nil {
+			return nil, err
+		}
+		if err := cfg.Validate(); err != nil {
+			return nil, err
+		}
+		return cfg, nil
 	}
 
-	if err := cfg.Validate(); err != nil {
-		return nil, err
+	names := make(map[string]bool)
+	var selected []*Config
+	for _, acct := range cfg.Accounts {
+		// Flags and environment variables override account settings too
+		parser := newParser(acct, flags.None)
+		if _, err := parser.ParseArgs(args); err != nil {
+			return nil, err
+		}
+		acct.recordFlagSources(parser)
+		acct.applyDefaults()
+		acct.expandPaths()
+		if acct.Name == "" {
+			acct.Name = acct.Username + "@" + acct.Server
+		}
+		if names[acct.Name] {
+			return nil, fmt.Errorf("duplicate account name: %s", acct.Name)
+		}
+		names[acct.Name] = true
+
+		if cfg.Account != "" && acct.Name != cfg.Account {
+			continue
+		}
+		if acct.expandErr != nil {
+			return nil, fmt.Errorf("account %s: %w", acct.Name, acct.expandErr)
+		}
+		if err := resolvePassword(acct, keyring); err != nil {
+			return nil, fmt.Errorf("account %s: %w", acct.Name, err)
+		}
+		if err := acct.Validate(); err != nil {
+			return nil, fmt.Errorf("account %s: %w", acct.Name, err)
+		}
+		selected = append(selected, acct)
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("account %q not found", cfg.Account)
+	}
+	// In watch mode each account writes its json_output after every check,
+	// which would replace what the others wrote to a shared file
+	if cfg.Watch {
+		owners := make(map[string]string)
+		for _, acct := range selected {
+			if acct.JSONOutput == "" {
+				continue
+			}
+			if other, ok := owners[acct.JSONOutput]; ok {
+				return nil, fmt.Errorf("accounts %s and %s can't share json_output in watch mode", other, acct.Name)
+			}
+			owners[acct.JSONOutput] = acct.Name
+		}
 	}
+	cfg.Accounts = selected
+	cfg.applyDefaults()
 
 	return cfg, nil
 }
 
+// applyDefaults fills in settings that weren't given a value. These are not
+// set with default tags, which go-flags would apply over values loaded from
+// the config file.
+func (c *Config) applyDefaults() {
+	// Set default for empty mailbox
+	if c.Mailbox == "" {
+		c.Mailbox = "Inbox"
+	}
+
+	// Set defaults for empty post_action and rejected_action
+	if c.PostAction == "" {
+		c.PostAction = PostActionNone
+	}
+	if c.RejectedAction == "" {
+		c.RejectedAction = PostActionNone
+	}
+
+	// Set defaults for connection security and the matching port
+	if c.Security == "" {
+		c.Security = SecurityTLS
+	}
+	if c.Port == 0 {
+		c.Port = defaultPort(c.Security)
+	}
+
+	// Set default for empty auth
+	if c.Auth == "" {
+		c.Auth = AuthPassword
+	}
+
+	// Set defaults for which attachments are saved
+	if len(c.IncludeTypes) == 0 {
+		c.IncludeTypes = slices.Clone(defaultIncludeTypes)
+	}
+	if c.TypeDetection == "" {
+		c.TypeDetection = TypeDetectionContent
+	}
+	if c.InlineImages == "" {
+		c.InlineImages = InlineAuto
+	}
+
+	// Set default for empty on_conflict
+	if c.OnConflict == "" {
+		c.OnConflict = ConflictSuffix
+	}
+
+	// Set defaults for state tracking
+	if c.State == "" {
+		c.State = StateAuto
+	}
+	if c.StateFile == "" {
+		c.StateFile = defaultStatePath()
+	}
+
+	// Set default for empty interval
+	if c.Interval == 0 {
+		c.Interval = defaultInterval
+	}
+}
+
 func findConfigFile(explicit string) (string, error) {
 	if explicit != "" {
+		explicit = expandHome(explicit)
 		if _, err := os.Stat(explicit); err != nil {
 			return "", fmt.Errorf("config file not found: %s", explicit)
 		}
@@ -119,10 +548,89 @@ func findConfigFile(explicit string) (string, error) {
 	return "", nil
 }
 
+// configSections holds the parts of a config file that are merged over the
+// top-level settings rather than decoded into Config directly.
+type configSections struct {
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+	Accounts []yaml.Node          `yaml:"accounts"`
+}
+
 func loadConfigFile(path string, cfg *Config) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return err
 	}
-	return yaml.Unmarshal(data, cfg)
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc.Kind == 0 {
+		// Empty file
+		return nil
+	}
+	// Only the selected profile and accounts are expanded, so that a
+	// variable used by another one needn't be set
+	if err := expandEnvNode(&doc, "profiles", "accounts"); err != nil {
+		return err
+	}
+
+	if err := doc.Decode(cfg); err != nil {
+		return err
+	}
+	cfg.recordFileSources(&doc)
+	var file configSections
+	if err := doc.Decode(&file); err != nil {
+		return err
+	}
+
+	// The selected profile overrides the top-level settings, and replaces
+	// the accounts if it defines its own
+	if cfg.Profile != "" {
+		profile, ok := file.Profiles[cfg.Profile]
+		if !ok {
+			return fmt.Errorf("profile %q not found (available: %s)", cfg.Profile, strings.Join(slices.Sorted(maps.Keys(file.Profiles)), ", "))
+		}
+		if err := expandEnvNode(&profile, "accounts"); err != nil {
+			return fmt.Errorf("profile %s: %w", cfg.Profile, err)
+		}
+		if err := profile.Decode(cfg); err != nil {
+			return fmt.Errorf("profile %s: %w", cfg.Profile, err)
+		}
+		cfg.recordFileSources(&profile)
+		var sections configSections
+		if err := profile.Decode(&sections); err != nil {
+			return fmt.Errorf("profile %s: %w", cfg.Profile, err)
+		}
+		if sections.Accounts != nil {
+			file.Accounts = sections.Accounts
+		}
+	}
+
+	// Each account starts from the top-level settings and overrides the
+	// ones it sets itself
+	for i := range file.Accounts {
+		acct := *cfg
+		acct.Accounts = nil
+		acct.sources = maps.Clone(cfg.sources)
+		// Copy the maps and slices, which decoding and flags add to, so
+		// that accounts don't share them with each other
+		acct.Mailboxes = slices.Clone(cfg.Mailboxes)
+		acct.Headers = maps.Clone(cfg.Headers)
+		acct.AllowSenders = slices.Clone(cfg.AllowSenders)
+		acct.DenySenders = slices.Clone(cfg.DenySenders)
+		acct.TLSPinSHA256 = slices.Clone(cfg.TLSPinSHA256)
+		acct.IncludeTypes = slices.Clone(cfg.IncludeTypes)
+		acct.ExcludeTypes = slices.Clone(cfg.ExcludeTypes)
+		acct.TypeDirs = maps.Clone(cfg.TypeDirs)
+		// Which accounts are selected isn't known until they are all
+		// named, so an undefined variable only fails an account that is
+		acct.expandErr = expandEnvNode(&file.Accounts[i])
+		if err := file.Accounts[i].Decode(&acct); err != nil {
+			return fmt.Errorf("account %d: %w", i+1, err)
+		}
+		acct.recordFileSources(&file.Accounts[i])
+		cfg.Accounts = append(cfg.Accounts, &acct)
+	}
+	return nil
 }
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"maps"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestConfigValidate(t *testing.T) {
@@ -28,6 +30,132 @@ func TestConfigValidate(t *testing.T) {
 			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", PostAction: "invalid"},
 			wantErr: "invalid post_action: invalid",
 		},
+		{
+			name:    "negative interval",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", Interval: -time.Second},
+			wantErr: "interval cannot be negative",
+		},
+		{
+			name:    "move rejected without rejected_move_to",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", RejectedAction: PostActionMove},
+			wantErr: "rejected_move_to is required when rejected_action is 'move'",
+		},
+		{
+			name:    "invalid rejected_action",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", RejectedAction: "bounce"},
+			wantErr: "invalid rejected_action: bounce",
+		},
+		{
+			name:    "invalid deny_senders pattern",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", DenySenders: []string{"[spam"}},
+			wantErr: "invalid pattern in deny_senders: [spam",
+		},
+		{
+			name:    "invalid include_types pattern",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", IncludeTypes: []string{"pdf"}},
+			wantErr: `invalid pattern in include_types: "pdf" is neither a MIME type nor an extension`,
+		},
+		{
+			name:    "type_dirs outside output",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", TypeDirs: map[string]string{".pdf": "../docs"}},
+			wantErr: "type_dirs entry .pdf must be a relative path inside the output directory",
+		},
+		{
+			name:    "max_bytes below min_bytes",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", MinBytes: 10 * kilobyte, MaxBytes: kilobyte},
+			wantErr: "max_bytes must not be less than min_bytes",
+		},
+		{
+			name:    "negative min_width",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", MinWidth: -1},
+			wantErr: "min_width and min_height can't be negative",
+		},
+		{
+			name:    "invalid type_detection",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", TypeDetection: "magic"},
+			wantErr: "invalid type_detection: magic",
+		},
+		{
+			name:    "dry run with watch",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", DryRun: true, Watch: true},
+			wantErr: "dry-run can't be used with watch",
+		},
+		{
+			name:    "invalid on_conflict",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", OnConflict: "rename"},
+			wantErr: "invalid on_conflict: rename",
+		},
+		{
+			name:    "invalid output_template",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", OutputTemplate: "{{.Filename"},
+			wantErr: "parsing output_template",
+		},
+		{
+			name:    "invalid state",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", State: "sqlite"},
+			wantErr: "invalid state: sqlite",
+		},
+		{
+			name:    "plaintext to remote host",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", Security: SecurityNone},
+			wantErr: "security none would send credentials to imap.example.com in plaintext; use starttls or tls, or set allow_plaintext to force it",
+		},
+		{
+			name: "plaintext to remote host forced",
+			cfg:  Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", Security: SecurityNone, AllowPlaintext: true},
+		},
+		{
+			name: "plaintext to localhost",
+			cfg:  Config{Server: "127.0.0.1", Username: "user", Password: "pass", Output: "/tmp", Security: SecurityNone},
+		},
+		{
+			name:    "invalid security",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", Security: "ssl"},
+			wantErr: "invalid security: ssl (must be tls, starttls, or none)",
+		},
+		{
+			name:    "client certificate without key",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", TLSCertFile: "client.pem"},
+			wantErr: "tls_cert_file and tls_key_file must be set together",
+		},
+		{
+			name:    "invalid tls_min_version",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", TLSMinVersion: "1.4"},
+			wantErr: "invalid tls_min_version: 1.4 (must be 1.0, 1.1, 1.2, or 1.3)",
+		},
+		{
+			name:    "invalid tls_pin_sha256",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", TLSPinSHA256: []string{"abc"}},
+			wantErr: `invalid tls_pin_sha256 "abc": must be a base64 SHA-256 digest`,
+		},
+		{
+			name:    "empty mailbox name",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", Mailboxes: []string{"INBOX", ""}},
+			wantErr: "mailboxes cannot contain an empty name",
+		},
+		{
+			name:    "missing password",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Output: "/tmp"},
+			wantErr: "password is required (set password, password_file, password_command, or password_keyring)",
+		},
+		{
+			name:    "oauth without token source",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Output: "/tmp", Auth: AuthXOAuth2, OAuth2TokenURL: "https://oauth2.example.com/token"},
+			wantErr: "xoauth2 requires oauth2_token",
+		},
+		{
+			name:    "invalid auth",
+			cfg:     Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp", Auth: "kerberos"},
+			wantErr: "invalid auth: kerberos",
+		},
+		{
+			name: "valid config with static oauth token",
+			cfg:  Config{Server: "imap.example.com", Username: "user", Output: "/tmp", Auth: AuthOAuthBearer, OAuth2Token: "token"},
+		},
+		{
+			name: "valid config with oauth refresh token",
+			cfg:  Config{Server: "imap.example.com", Username: "user", Output: "/tmp", Auth: AuthXOAuth2, OAuth2TokenURL: "https://oauth2.example.com/token", OAuth2RefreshToken: "refresh"},
+		},
 		{
 			name: "valid config with defaults",
 			cfg:  Config{Server: "imap.example.com", Username: "user", Password: "pass", Output: "/tmp"},
@@ -71,6 +199,8 @@ mailbox: INBOX
 output: /tmp/attachments
 post_action: none
 verbose: true
+watch: true
+interval: 5m
 `
 	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
 		t.Fatalf("failed to write test config: %v", err)
@@ -105,6 +235,263 @@ verbose: true
 	if !cfg.Verbose {
 		t.Errorf("expected verbose true, got false")
 	}
+	if !cfg.Watch {
+		t.Errorf("expected watch true, got false")
+	}
+	if cfg.Interval != 5*time.Minute {
+		t.Errorf("expected interval 5m, got %s", cfg.Interval)
+	}
+}
+
+func TestLoadConfig_KeepsFileValues(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configContent := `server: imap.example.com
+username: testuser
+password: testpass
+mailbox: Photos
+output: /tmp/attachments
+post_action: move
+move_to: Archive
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	cfg, err := loadConfig([]string{"-c", configPath}, nil)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	// Defaults must not replace values from the config file
+	if cfg.Mailbox != "Photos" {
+		t.Errorf("expected mailbox 'Photos', got %q", cfg.Mailbox)
+	}
+	if cfg.PostAction != PostActionMove {
+		t.Errorf("expected post_action 'move', got %q", cfg.PostAction)
+	}
+	if cfg.Port != 993 {
+		t.Errorf("expected default port 993, got %d", cfg.Port)
+	}
+}
+
+func TestLoadConfig_Accounts(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configContent := `password: shared
+mailbox: Photos
+output: /photos
+post_action: move
+move_to: Archive
+accounts:
+  - name: personal
+    server: imap.gmail.com
+    username: me@gmail.com
+  - server: imap.work.example.com
+    username: me@work.example.com
+    security: starttls
+    output: /photos/work
+    post_action: none
+    mailboxes: [INBOX, "Scans/*"]
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	cfg, err := loadConfig([]string{"-c", configPath, "-v"}, nil)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if len(cfg.Accounts) != 2 {
+		t.Fatalf("expected 2 accounts, got %d", len(cfg.Accounts))
+	}
+
+	personal, work := cfg.Accounts[0], cfg.Accounts[1]
+	if personal.Name != "personal" || personal.Server != "imap.gmail.com" || personal.Password != "shared" {
+		t.Errorf("unexpected personal account: %+v", personal)
+	}
+	if personal.Output != "/photos" || personal.Mailbox != "Photos" || personal.PostAction != PostActionMove || personal.Port != 993 {
+		t.Errorf("expected personal account to inherit top-level settings, got %+v", personal)
+	}
+	if !personal.Verbose || !work.Verbose {
+		t.Error("expected flags to apply to every account")
+	}
+
+	if work.Name != "me@work.example.com@imap.work.example.com" {
+		t.Errorf("expected default account name, got %q", work.Name)
+	}
+	if work.Output != "/photos/work" || work.PostAction != PostActionNone || work.Port != 143 {
+		t.Errorf("expected work account overrides, got %+v", work)
+	}
+	if len(work.Mailboxes) != 2 || work.Mailboxes[1] != "Scans/*" {
+		t.Errorf("expected work mailboxes [INBOX Scans/*], got %v", work.Mailboxes)
+	}
+
+	// Select a single account and override a setting from the command line
+	cfg, err = loadConfig([]string{"-c", configPath, "--account", "personal", "-o", "/override"}, nil)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if len(cfg.Accounts) != 1 || cfg.Accounts[0].Name != "personal" {
+		t.Fatalf("expected only the personal account, got %d account(s)", len(cfg.Accounts))
+	}
+	if cfg.Accounts[0].Output != "/override" {
+		t.Errorf("expected flag to override account output, got %q", cfg.Accounts[0].Output)
+	}
+
+	if _, err := loadConfig([]string{"-c", configPath, "--account", "missing"}, nil); err == nil {
+		t.Error("expected error for unknown account, got nil")
+	}
+}
+
+func TestLoadConfig_AccountMaps(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configContent := `server: imap.example.com
+password: pass
+output: /photos
+headers:
+  X-Top: a
+type_dirs:
+  image/*: images
+accounts:
+  - name: one
+    username: one@example.com
+    headers:
+      X-One: b
+    type_dirs:
+      application/pdf: one
+  - name: two
+    username: two@example.com
+    headers:
+      X-Two: c
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	cfg, err := loadConfig([]string{"-c", configPath}, nil)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	one, two := cfg.Accounts[0], cfg.Accounts[1]
+
+	// Each account adds to the top-level maps without changing them
+	wantOne := map[string]string{"X-Top": "a", "X-One": "b"}
+	wantTwo := map[string]string{"X-Top": "a", "X-Two": "c"}
+	if !maps.Equal(one.Headers, wantOne) || !maps.Equal(two.Headers, wantTwo) {
+		t.Errorf("expected headers %v and %v, got %v and %v", wantOne, wantTwo, one.Headers, two.Headers)
+	}
+	if _, ok := cfg.Headers["X-One"]; ok {
+		t.Errorf("expected the top-level headers not to change, got %v", cfg.Headers)
+	}
+	if !maps.Equal(one.TypeDirs, map[string]string{"image/*": "images", "application/pdf": "one"}) {
+		t.Errorf("unexpected type_dirs for one: %v", one.TypeDirs)
+	}
+	if !maps.Equal(two.TypeDirs, map[string]string{"image/*": "images"}) {
+		t.Errorf("expected type_dirs for two without those of one, got %v", two.TypeDirs)
+	}
+}
+
+func TestLoadConfig_InvalidAccount(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configContent := `output: /photos
+accounts:
+  - name: incomplete
+    server: imap.example.com
+    password: pass
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	_, err := loadConfig([]string{"-c", configPath}, nil)
+	if err == nil || err.Error() != "account incomplete: username is required" {
+		t.Errorf("expected missing username error for account, got %v", err)
+	}
+}
+
+func TestLoadConfig_AccountsSharedJSONOutputWatch(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configContent := `username: me@example.com
+password: pass
+output: /photos
+json_output: /photos/results.json
+accounts:
+  - name: personal
+    server: imap.example.com
+  - name: work
+    server: imap.work.example.com
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	if _, err := loadConfig([]string{"-c", configPath}, nil); err != nil {
+		t.Fatalf("expected a shared json_output to be allowed without watch, got %v", err)
+	}
+	_, err := loadConfig([]string{"-c", configPath, "--watch"}, nil)
+	if err == nil || err.Error() != "accounts personal and work can't share json_output in watch mode" {
+		t.Errorf("expected shared json_output error in watch mode, got %v", err)
+	}
+}
+
+func TestLoadConfigFile_Profile(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configContent := `server: imap.example.com
+username: me@example.com
+password: pass
+output: /photos
+profiles:
+  work:
+    server: imap.work.example.com
+    username: me@work.example.com
+    output: /photos/work
+  family:
+    output: /photos/family
+    accounts:
+      - name: mum
+        username: mum@example.com
+      - name: dad
+        username: dad@example.com
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	cfg := &Config{Profile: "work"}
+	if err := loadConfigFile(configPath, cfg); err != nil {
+		t.Fatalf("loadConfigFile failed: %v", err)
+	}
+	if cfg.Server != "imap.work.example.com" || cfg.Username != "me@work.example.com" || cfg.Output != "/photos/work" {
+		t.Errorf("expected work profile to override top-level settings, got %+v", cfg)
+	}
+	if cfg.Password != "pass" {
+		t.Errorf("expected password to be inherited from top level, got %q", cfg.Password)
+	}
+
+	// Profiles can define accounts, which inherit from the profile
+	cfg = &Config{Profile: "family"}
+	if err := loadConfigFile(configPath, cfg); err != nil {
+		t.Fatalf("loadConfigFile failed: %v", err)
+	}
+	if len(cfg.Accounts) != 2 {
+		t.Fatalf("expected 2 accounts, got %d", len(cfg.Accounts))
+	}
+	if acct := cfg.Accounts[1]; acct.Name != "dad" || acct.Server != "imap.example.com" || acct.Output != "/photos/family" {
+		t.Errorf("unexpected account from family profile: %+v", acct)
+	}
+
+	// Without a profile only the top-level settings apply
+	cfg = &Config{}
+	if err := loadConfigFile(configPath, cfg); err != nil {
+		t.Fatalf("loadConfigFile failed: %v", err)
+	}
+	if cfg.Output != "/photos" || len(cfg.Accounts) != 0 {
+		t.Errorf("expected top-level settings only, got %+v", cfg)
+	}
+
+	err := loadConfigFile(configPath, &Config{Profile: "missing"})
+	if err == nil || err.Error() != `profile "missing" not found (available: family, work)` {
+		t.Errorf("expected profile not found error, got %v", err)
+	}
 }
 
 func TestFindConfigFile(t *testing.T) {
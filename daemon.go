@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+const defaultInterval = time.Minute
+
+// The delays between reconnection attempts in watch mode. They are variables
+// so that tests can shorten them.
+var (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 5 * time.Minute
+)
+
+// backoff produces exponentially increasing delays between reconnection
+// attempts, capped at max.
+type backoff struct {
+	min  time.Duration
+	max  time.Duration
+	next time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{min: min, max: max, next: min}
+}
+
+// Next returns the delay to wait before the next attempt.
+func (b *backoff) Next() time.Duration {
+	d := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return d
+}
+
+// Reset restores the initial delay after a successful attempt.
+func (b *backoff) Reset() {
+	b.next = b.min
+}
+
+// sleepContext waits for d to elapse. It returns false if ctx is cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// runWatch keeps a single connection open and processes new messages as they
+// arrive until ctx is cancelled, reconnecting with exponential backoff when
+// the connection fails. New mail is detected with IMAP IDLE when the server
+// supports it and a single mailbox is checked, and by polling every
+// cfg.Interval otherwise.
+func runWatch(ctx context.Context, cfg *Config, verbose func(string, ...any)) int {
+	retry := newBackoff(minReconnectDelay, maxReconnectDelay)
+
+	var client *MailClient
+	defer func() {
+		if client != nil {
+			_ = client.Close()
+		}
+	}()
+
+	verbose("Watching for new messages")
+
+	for ctx.Err() == nil {
+		if client == nil {
+			c, err := NewMailClient(cfg, verbose)
+			if err != nil {
+				delay := retry.Next()
+				fmt.Fprintf(os.Stderr, "%sError: %v (retrying in %s)\n", cfg.logPrefix(), err, delay)
+				sleepContext(ctx, delay)
+				continue
+			}
+			client = c
+		}
+
+		stats, code := processNewMessages(ctx, cfg, client, verbose)
+		saveJSONOutput(cfg.JSONOutput, stats.Output)
+		switch code {
+		case exitOK:
+			// Only a pass that worked shows the problem is gone. Logging
+			// in again is no proof, as a mailbox that can't be selected
+			// fails every time.
+			retry.Reset()
+		case exitProcessError:
+			// Assume the connection is broken and start over. The error
+			// has already been printed.
+			_ = client.Close()
+			client = nil
+			delay := retry.Next()
+			verbose("Reconnecting in %s", delay)
+			sleepContext(ctx, delay)
+			continue
+		default:
+			return code
+		}
+
+		if stats.Messages > 0 && !cfg.Quiet {
+			printSummary(cfg.logPrefix(), stats)
+		}
+
+		// IDLE only watches the selected mailbox, so poll when there are
+		// several
+		if cfg.NoIdle || len(stats.Mailboxes) != 1 {
+			sleepContext(ctx, cfg.Interval)
+			continue
+		}
+		if err := client.WaitForNewMail(ctx, cfg.Interval); err != nil {
+			fmt.Fprintf(os.Stderr, "%sError: %v\n", cfg.logPrefix(), err)
+			_ = client.Close()
+			client = nil
+		}
+	}
+
+	verbose("Shutting down")
+	return exitOK
+}
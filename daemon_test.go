@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, 10*time.Second)
+
+	want := []time.Duration{
+		1 * time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+	for i, w := range want {
+		if got := b.Next(); got != w {
+			t.Errorf("attempt %d: expected %s, got %s", i+1, w, got)
+		}
+	}
+
+	b.Reset()
+	if got := b.Next(); got != time.Second {
+		t.Errorf("expected %s after reset, got %s", time.Second, got)
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+	if !sleepContext(context.Background(), time.Millisecond) {
+		t.Error("expected sleep to complete")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if sleepContext(ctx, time.Hour) {
+		t.Error("expected sleep to be interrupted by cancelled context")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("sleep was not interrupted promptly")
+	}
+}
+
+// watchLog collects the verbose output of runWatch, which runs in its own
+// goroutine.
+type watchLog struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *watchLog) verbose(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+// matching returns the lines logged so far that start with prefix.
+func (l *watchLog) matching(prefix string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var lines []string
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// waitFor polls cond until it is true, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startWatch runs runWatch for cfg until the returned function is called,
+// which returns its exit code.
+func startWatch(t *testing.T, cfg *Config, log *watchLog) func() int {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int, 1)
+	go func() { done <- runWatch(ctx, cfg, log.verbose) }()
+
+	stop := func() int {
+		cancel()
+		select {
+		case code := <-done:
+			return code
+		case <-time.After(5 * time.Second):
+			t.Fatal("runWatch didn't stop after cancellation")
+			return -1
+		}
+	}
+	t.Cleanup(func() { cancel() })
+	return stop
+}
+
+func TestRunWatch(t *testing.T) {
+	addr, user := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+	appendTestMessage(t, user, "INBOX", testImageMessage("first.jpg", []byte("\xff\xd8\xff\xe0first")))
+
+	cfg := newTestConfig(t, addr)
+	cfg.NoIdle = true
+	cfg.Interval = 20 * time.Millisecond
+	cfg.Quiet = true
+
+	log := &watchLog{}
+	stop := startWatch(t, cfg, log)
+
+	exists := func(name string) func() bool {
+		return func() bool {
+			_, err := os.Stat(filepath.Join(cfg.Output, name))
+			return err == nil
+		}
+	}
+	waitFor(t, "the first message", exists("first.jpg"))
+
+	// Messages arriving later are picked up on the same connection
+	appendTestMessage(t, user, "INBOX", testImageMessage("second.jpg", []byte("\xff\xd8\xff\xe0second")))
+	waitFor(t, "the second message", exists("second.jpg"))
+
+	if code := stop(); code != exitOK {
+		t.Errorf("expected exit code %d after shutdown, got %d", exitOK, code)
+	}
+	if lines := log.matching("Reconnecting"); len(lines) != 0 {
+		t.Errorf("expected no reconnections, got %v", lines)
+	}
+	if lines := log.matching("Shutting down"); len(lines) != 1 {
+		t.Errorf("expected a clean shutdown, got %v", log.lines)
+	}
+}
+
+func TestRunWatch_Backoff(t *testing.T) {
+	defer func(min, max time.Duration) {
+		minReconnectDelay, maxReconnectDelay = min, max
+	}(minReconnectDelay, maxReconnectDelay)
+	minReconnectDelay, maxReconnectDelay = 10*time.Millisecond, time.Second
+
+	addr, _ := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+
+	// Logging in works, but the mailbox can't be selected on any attempt
+	cfg := newTestConfig(t, addr)
+	cfg.Mailbox = "Missing"
+	cfg.NoIdle = true
+	cfg.Interval = 10 * time.Millisecond
+	cfg.Quiet = true
+
+	log := &watchLog{}
+	stop := startWatch(t, cfg, log)
+	waitFor(t, "reconnections", func() bool { return len(log.matching("Reconnecting")) >= 3 })
+	stop()
+
+	want := []string{"Reconnecting in 10ms", "Reconnecting in 20ms", "Reconnecting in 40ms"}
+	if got := log.matching("Reconnecting"); !slices.Equal(got[:3], want) {
+		t.Errorf("expected the delay to grow while every pass fails, got %v", got)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+type checkStatus string
+
+const (
+	checkOK   checkStatus = "ok"
+	checkWarn checkStatus = "warn"
+	checkFail checkStatus = "FAIL"
+)
+
+// doctor reports the results of checking one account's setup.
+type doctor struct {
+	w             io.Writer
+	failed        bool
+	connectFailed bool
+}
+
+func (d *doctor) report(status checkStatus, format string, args ...any) {
+	if status == checkFail {
+		d.failed = true
+	}
+	fmt.Fprintf(d.w, "  %-4s  %s\n", status, fmt.Sprintf(format, args...))
+}
+
+// runDoctor prints the effective configuration of each account and checks
+// that mailgrab can work with its server and output directory.
+func runDoctor(cfg *Config) int {
+	accounts := cfg.Accounts
+	if len(accounts) == 0 {
+		accounts = []*Config{cfg}
+	}
+
+	config := cfg.Config
+	if config == "" {
+		config = "none"
+	}
+	fmt.Printf("Config file: %s\n", config)
+	if cfg.Profile != "" {
+		fmt.Printf("Profile: %s\n", cfg.Profile)
+	}
+
+	code := exitOK
+	for _, acct := range accounts {
+		fmt.Println()
+		if acct.Name != "" {
+			fmt.Printf("Account %s\n\n", acct.Name)
+		}
+		if c := diagnose(os.Stdout, acct); code == exitOK {
+			code = c
+		}
+	}
+	return code
+}
+
+// diagnose prints the configuration of a single account and runs the checks
+// against it. It returns exitConnectError if the server couldn't be reached,
+// exitConfigError if another check failed, and exitOK otherwise.
+func diagnose(w io.Writer, cfg *Config) int {
+	fmt.Fprintln(w, "Configuration:")
+	printConfig(w, cfg)
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Checks:")
+	d := &doctor{w: w}
+	checkServer(d, cfg)
+	checkOutput(d, cfg.Output)
+
+	switch {
+	case d.connectFailed:
+		return exitConnectError
+	case d.failed:
+		return exitConfigError
+	}
+	return exitOK
+}
+
+// printConfig prints every setting that has a value, with secrets redacted,
+// and where it was set.
+func printConfig(w io.Writer, cfg *Config) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if key == "" || key == "-" || key == "name" {
+			continue
+		}
+		value := v.Field(i)
+		src := cfg.source(field.Name)
+		if value.IsZero() && src == sourceDefault {
+			continue
+		}
+
+		var text string
+		switch {
+		case field.Tag.Get("secret") == "true":
+			text = "<redacted>"
+		case value.Kind() == reflect.Map:
+			var items []string
+			for _, key := range value.MapKeys() {
+				items = append(items, fmt.Sprintf("%v: %v", key.Interface(), value.MapIndex(key).Interface()))
+			}
+			slices.Sort(items)
+			text = strings.Join(items, ", ")
+		case value.Kind() == reflect.Slice:
+			var items []string
+			for j := 0; j < value.Len(); j++ {
+				items = append(items, fmt.Sprint(value.Index(j).Interface()))
+			}
+			text = strings.Join(items, ", ")
+		default:
+			text = fmt.Sprint(value.Interface())
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t(%s)\n", key, text, src)
+	}
+	_ = tw.Flush()
+}
+
+// checkServer connects to the server and checks that the mailboxes and
+// post-actions can be used.
+func checkServer(d *doctor, cfg *Config) {
+	client, err := NewMailClient(cfg, func(string, ...any) {})
+	if err != nil {
+		d.report(checkFail, "Connecting to %s:%d: %v", cfg.Server, cfg.Port, err)
+		d.connectFailed = true
+		return
+	}
+	defer func() { _ = client.Close() }()
+
+	d.report(checkOK, "Connected to %s:%d (%s)", cfg.Server, cfg.Port, cfg.Security)
+	d.report(checkOK, "Authenticated as %s (%s)", cfg.Username, cfg.Auth)
+
+	d.report(checkOK, "Server capabilities: %s", strings.Join(client.Capabilities(), " "))
+	caps := client.client.Caps()
+	if cfg.Watch && !cfg.NoIdle && !caps.Has(imap.CapIdle) {
+		d.report(checkWarn, "Server doesn't support IDLE, watch mode will poll every %s", cfg.Interval)
+	}
+	if cfg.PostAction == PostActionDelete && !caps.Has(imap.CapUIDPlus) && !caps.Has(imap.CapIMAP4rev2) {
+		d.report(checkFail, "post_action delete needs the UIDPLUS extension, which the server doesn't support")
+	}
+
+	mailboxes, err := client.ResolveMailboxes()
+	if err != nil {
+		d.report(checkFail, "%v", err)
+	} else if len(mailboxes) == 0 {
+		d.report(checkWarn, "No mailboxes match %s", strings.Join(cfg.MailboxList(), ", "))
+	}
+	for _, mailbox := range mailboxes {
+		checkMailbox(d, cfg, client, mailbox)
+	}
+
+	if cfg.PostAction == PostActionMove {
+		checkMoveTarget(d, client, "move_to", cfg.MoveTo)
+	}
+	if cfg.RejectedAction == PostActionMove {
+		checkMoveTarget(d, client, "rejected_move_to", cfg.RejectedMoveTo)
+	}
+}
+
+// checkMoveTarget checks that the mailbox set by the setting called name
+// exists.
+func checkMoveTarget(d *doctor, client *MailClient, name, mailbox string) {
+	exists, err := client.MailboxExists(mailbox)
+	switch {
+	case err != nil:
+		d.report(checkFail, "Looking up %s mailbox %s: %v", name, mailbox, err)
+	case !exists:
+		d.report(checkFail, "%s mailbox %s doesn't exist", name, mailbox)
+	default:
+		d.report(checkOK, "%s mailbox %s exists", name, mailbox)
+	}
+}
+
+// checkMailbox checks that mailbox can be opened and how processed messages
+// in it will be tracked.
+func checkMailbox(d *doctor, cfg *Config, client *MailClient, mailbox string) {
+	data, err := client.Examine(mailbox)
+	if err != nil {
+		d.report(checkFail, "Mailbox %s: %v", mailbox, err)
+		return
+	}
+	d.report(checkOK, "Mailbox %s exists (%d message(s))", mailbox, data.NumMessages)
+
+	if cfg.State == StateFile {
+		d.report(checkOK, "Processed messages in %s are tracked in %s", mailbox, cfg.StateFile)
+		return
+	}
+
+	var flags []string
+	for _, flag := range data.PermanentFlags {
+		flags = append(flags, string(flag))
+	}
+	switch {
+	case canStoreKeyword(data.PermanentFlags):
+		d.report(checkOK, "The %s keyword can be stored in %s", seenKeyword, mailbox)
+	case cfg.State == StateKeyword:
+		d.report(checkFail, "The %s keyword can't be stored in %s (PERMANENTFLAGS: %s), set state to auto or file", seenKeyword, mailbox, strings.Join(flags, " "))
+	default:
+		d.report(checkWarn, "The %s keyword can't be stored in %s (PERMANENTFLAGS: %s), processed messages will be tracked in %s", seenKeyword, mailbox, strings.Join(flags, " "), cfg.StateFile)
+	}
+}
+
+// checkOutput checks that files can be created in the output directory, or
+// that it can be created if it doesn't exist yet.
+func checkOutput(d *doctor, dir string) {
+	existing, err := writableDir(dir)
+	switch {
+	case err != nil:
+		d.report(checkFail, "Output directory %s is not writable: %v", dir, err)
+	case existing != dir:
+		d.report(checkOK, "Output directory %s will be created in %s", dir, existing)
+	default:
+		d.report(checkOK, "Output directory %s is writable", dir)
+	}
+}
+
+// writableDir checks that a file can be created in dir or, if dir doesn't
+// exist, in its nearest existing parent. It returns the directory that was
+// checked.
+func writableDir(dir string) (string, error) {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return dir, fmt.Errorf("%s is not a directory", dir)
+			}
+			f, err := os.CreateTemp(dir, ".mailgrab-doctor-*")
+			if err != nil {
+				return dir, err
+			}
+			_ = f.Close()
+			return dir, os.Remove(f.Name())
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return dir, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir, err
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestPrintConfig_Sources(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configContent := `server: imap.example.com
+username: user@example.com
+password: hunter2
+output: /photos
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+	t.Setenv("MAILGRAB_MAILBOX", "Photos")
+
+	cfg, err := loadConfig([]string{"doctor", "-c", configPath, "--post-action", "delete"}, nil)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	printConfig(&buf, cfg)
+	out := buf.String()
+
+	for _, want := range [][]string{
+		{"server", "imap.example.com", "(file)"},
+		{"password", "<redacted>", "(file)"},
+		{"mailbox", "Photos", "(env)"},
+		{"post_action", "delete", "(flag)"},
+		{"security", "tls", "(default)"},
+		{"port", "993", "(default)"},
+	} {
+		if !containsLine(out, want...) {
+			t.Errorf("expected a line with %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("password was not redacted:\n%s", out)
+	}
+	if strings.Contains(out, "move_to") {
+		t.Errorf("unset move_to should not be printed:\n%s", out)
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	addr, user := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+	if err := user.Create("Photos", nil); err != nil {
+		t.Fatalf("creating mailbox: %v", err)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("splitting address: %v", err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	newConfig := func() *Config {
+		cfg := &Config{
+			Server:   host,
+			Port:     port,
+			Security: SecurityNone,
+			Username: "user",
+			Password: "pass",
+			Output:   filepath.Join(t.TempDir(), "photos"),
+		}
+		cfg.applyDefaults()
+		return cfg
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.PostAction = PostActionMove
+		cfg.MoveTo = "Photos"
+
+		var buf bytes.Buffer
+		if code := diagnose(&buf, cfg); code != exitOK {
+			t.Fatalf("diagnose returned %d, want %d:\n%s", code, exitOK, buf.String())
+		}
+		out := buf.String()
+		for _, want := range []string{"Authenticated as user", "Mailbox Inbox exists", "move_to mailbox Photos exists", "will be created in"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("expected %q in:\n%s", want, out)
+			}
+		}
+		if !containsLine(out, "Server capabilities", "IMAP4rev1") {
+			t.Errorf("expected the server capabilities in:\n%s", out)
+		}
+	})
+
+	t.Run("missing move_to", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.PostAction = PostActionMove
+		cfg.MoveTo = "Archive"
+
+		var buf bytes.Buffer
+		if code := diagnose(&buf, cfg); code != exitConfigError {
+			t.Fatalf("diagnose returned %d, want %d:\n%s", code, exitConfigError, buf.String())
+		}
+		if !containsLine(buf.String(), "FAIL", "move_to mailbox Archive doesn't exist") {
+			t.Errorf("expected the move_to check to fail:\n%s", buf.String())
+		}
+	})
+
+	t.Run("missing mailbox", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.Mailbox = "Scans"
+
+		var buf bytes.Buffer
+		if code := diagnose(&buf, cfg); code != exitConfigError {
+			t.Fatalf("diagnose returned %d, want %d:\n%s", code, exitConfigError, buf.String())
+		}
+		if !containsLine(buf.String(), "FAIL", "Mailbox Scans") {
+			t.Errorf("expected the mailbox check to fail:\n%s", buf.String())
+		}
+	})
+
+	t.Run("bad password", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.Password = "wrong"
+
+		var buf bytes.Buffer
+		if code := diagnose(&buf, cfg); code != exitConnectError {
+			t.Fatalf("diagnose returned %d, want %d:\n%s", code, exitConnectError, buf.String())
+		}
+		// The output directory is still checked
+		if !strings.Contains(buf.String(), "Output directory") {
+			t.Errorf("expected the output directory to be checked:\n%s", buf.String())
+		}
+	})
+}
+
+func TestWritableDir(t *testing.T) {
+	dir := t.TempDir()
+
+	if got, err := writableDir(dir); err != nil || got != dir {
+		t.Errorf("writableDir(%q) = %q, %v; want %q, nil", dir, got, err, dir)
+	}
+
+	missing := filepath.Join(dir, "a", "b")
+	if got, err := writableDir(missing); err != nil || got != dir {
+		t.Errorf("writableDir(%q) = %q, %v; want %q, nil", missing, got, err, dir)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := writableDir(filepath.Join(file, "photos")); err == nil {
+		t.Error("expected an error for a path below a file, got nil")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("reading dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the test file to be left in %s, got %d entries", dir, len(entries))
+	}
+}
+
+func TestLoadConfig_DoctorCommand(t *testing.T) {
+	for _, name := range []string{"doctor", "check-config"} {
+		cfg, err := loadConfig([]string{name, "-s", "imap.example.com", "-u", "user", "-P", "pass", "-o", "/photos"}, nil)
+		if err != nil {
+			t.Fatalf("loadConfig with %s failed: %v", name, err)
+		}
+		if cfg.Command != "doctor" {
+			t.Errorf("%s: expected command doctor, got %q", name, cfg.Command)
+		}
+	}
+
+	cfg, err := loadConfig([]string{"-s", "imap.example.com", "-u", "user", "-P", "pass", "-o", "/photos"}, nil)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if cfg.Command != "" {
+		t.Errorf("expected no command, got %q", cfg.Command)
+	}
+}
+
+// containsLine reports whether out has a line containing each of parts in
+// order.
+func containsLine(out string, parts ...string) bool {
+	for _, line := range strings.Split(out, "\n") {
+		rest, ok := line, true
+		for _, part := range parts {
+			i := strings.Index(rest, part)
+			if i < 0 {
+				ok = false
+				break
+			}
+			rest = rest[i+len(part):]
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// dryRunPlanner works out what processing messages would do, for
+// --dry-run, without saving files or changing anything on the server.
+// Mailboxes are opened read-only, and only the envelope and body structure of
+// each message are fetched.
+type dryRunPlanner struct {
+	FileWriter
+	prefix string
+	// planned holds the paths that earlier attachments would have been saved
+	// to, so that conflicts between them are resolved as in a real run
+	planned map[string]bool
+}
+
+func newDryRunPlanner(fw FileWriter, prefix string) *dryRunPlanner {
+	return &dryRunPlanner{FileWriter: fw, prefix: prefix, planned: make(map[string]bool)}
+}
+
+func (p *dryRunPlanner) Exists(path string) bool {
+	return p.planned[path] || p.FileWriter.Exists(path)
+}
+
+func (p *dryRunPlanner) printf(format string, args ...any) {
+	fmt.Println(p.prefix + fmt.Sprintf(format, args...))
+}
+
+// planMessage prints where the candidate attachments of msg would be saved
+// and what the post-action would do with it, or, if its sender isn't allowed,
+// what the rejected_action would do. It returns the number of files that would
+// be saved.
+func (p *dryRunPlanner) planMessage(cfg *Config, msg Message, candidates []Attachment, opts SaveOptions) int {
+	p.printf("Message %d from %s: %q", msg.UID, msg.From, msg.Subject)
+	if !senderAllowed(cfg.AllowSenders, cfg.DenySenders, msg.From) {
+		p.printf("  Sender not allowed")
+		p.planAction(cfg.RejectedAction, cfg.RejectedMoveTo)
+		return 0
+	}
+	if len(candidates) == 0 {
+		p.printf("  No matching attachments")
+	}
+
+	saved := 0
+	opts.Message = &msg
+	types := cfg.typeFilter()
+	sizes := cfg.sizeFilter()
+	for _, att := range candidates {
+		if err := sizes.Precheck(att); err != nil {
+			p.printf("  Would skip %s: %v", att.Filename, err)
+			continue
+		}
+		outputDir := filepath.Join(cfg.Output, types.Dir(att))
+		path, err := PlanAttachmentPath(p, outputDir, att, opts)
+		if errors.Is(err, ErrFileExists) {
+			p.printf("  Would skip %s: %s already exists", att.Filename, path)
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sError: saving attachment %s: %v\n", cfg.logPrefix(), att.Filename, err)
+			continue
+		}
+		p.planned[path] = true
+		format := "  Would save %s to %s"
+		if !types.matches(att.MIMEType, att.Filename) {
+			// Only type_detection content lets these through, and the
+			// content isn't known until it's downloaded
+			format += ", if its content is an image"
+		}
+		if att.MaybeShown {
+			format += ", unless shown in the HTML body"
+		}
+		p.printf(format, att.Filename, path)
+		saved++
+	}
+
+	p.planAction(cfg.PostAction, cfg.MoveTo)
+	return saved
+}
+
+// planAction prints what action would do with a message.
+func (p *dryRunPlanner) planAction(action PostAction, moveTo string) {
+	switch action {
+	case PostActionDelete:
+		p.printf("  Would delete the message")
+	case PostActionMove:
+		p.printf("  Would move the message to %s", moveTo)
+	}
+}
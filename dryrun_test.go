@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessNewMessages_DryRun(t *testing.T) {
+	cfg := newTestAccount(t, "photo")
+	cfg.PostAction = PostActionDelete
+	cfg.JSONOutput = filepath.Join(t.TempDir(), "results.json")
+	cfg.DryRun = true
+
+	stats, code := runOnce(context.Background(), cfg, func(string, ...any) {})
+	if code != exitOK {
+		t.Fatalf("dry run returned %d, want %d", code, exitOK)
+	}
+	if stats.Messages != 1 || stats.Saved != 1 || !stats.DryRun {
+		t.Errorf("expected a dry run of 1 message and 1 image, got %+v", stats)
+	}
+	if len(stats.Output) != 0 {
+		t.Errorf("expected no JSON output from a dry run, got %v", stats.Output)
+	}
+	if _, err := os.Stat(cfg.Output); !os.IsNotExist(err) {
+		t.Errorf("expected %s not to be created, got %v", cfg.Output, err)
+	}
+
+	// The message was neither marked as processed nor deleted
+	cfg.DryRun = false
+	stats, code = runOnce(context.Background(), cfg, func(string, ...any) {})
+	if code != exitOK {
+		t.Fatalf("real run returned %d, want %d", code, exitOK)
+	}
+	if stats.Messages != 1 || stats.Saved != 1 {
+		t.Errorf("expected the real run to process 1 message and 1 image, got %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Output, "photo.jpg")); err != nil {
+		t.Errorf("expected the image to be saved: %v", err)
+	}
+}
+
+func TestDryRunPlanner_Conflicts(t *testing.T) {
+	outputDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outputDir, "a.jpg"), nil, 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	cfg := &Config{Output: outputDir, PostAction: PostActionNone}
+	planner := newDryRunPlanner(OSFileWriter{}, "")
+	images := []Attachment{
+		{Filename: "a.jpg", MIMEType: "image/jpeg"},
+		{Filename: "a.jpg", MIMEType: "image/jpeg"},
+		{Filename: "b.jpg", MIMEType: "image/jpeg"},
+	}
+	if saved := planner.planMessage(cfg, Message{UID: 1}, images, SaveOptions{OnConflict: ConflictSuffix}); saved != 3 {
+		t.Errorf("expected 3 images to be planned, got %d", saved)
+	}
+
+	// Later attachments don't reuse a path an earlier one would have taken
+	for _, name := range []string{"a (1).jpg", "a (2).jpg", "b.jpg"} {
+		if !planner.planned[filepath.Join(outputDir, name)] {
+			t.Errorf("expected %s to be planned, got %v", name, planner.planned)
+		}
+	}
+	entries, _ := os.ReadDir(outputDir)
+	if len(entries) != 1 {
+		t.Errorf("expected nothing to be written to %s, got %d entries", outputDir, len(entries))
+	}
+}
+
+func TestProcessNewMessages_DryRunStateFile(t *testing.T) {
+	cfg := newTestAccount(t, "photo")
+	cfg.State = StateFile
+
+	stats, code := runOnce(context.Background(), cfg, func(string, ...any) {})
+	if code != exitOK || stats.Saved != 1 {
+		t.Fatalf("real run returned %d with %+v, want 1 image saved", code, stats)
+	}
+
+	// Examined mailboxes have no permanent flags, so the state file that
+	// tracks the mailbox decides what was processed
+	cfg.State = StateAuto
+	cfg.DryRun = true
+	stats, code = runOnce(context.Background(), cfg, func(string, ...any) {})
+	if code != exitOK {
+		t.Fatalf("dry run returned %d, want %d", code, exitOK)
+	}
+	if stats.Messages != 0 {
+		t.Errorf("expected the processed message to be left out, got %+v", stats)
+	}
+}
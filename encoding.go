@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/charset"
+	"golang.org/x/text/unicode/norm"
+)
+
+// decodeTransferEncoding wraps r with a decoder for the given
+// Content-Transfer-Encoding, as reported by the part's body structure.
+func decodeTransferEncoding(r io.Reader, encoding string) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "7bit", "8bit", "binary":
+		return r, nil
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: r}), nil
+	case "quoted-printable":
+		return quotedprintable.NewReader(r), nil
+	case "x-uuencode", "x-uue", "uuencode", "uue":
+		return newUUDecoder(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported transfer encoding: %s", encoding)
+	}
+}
+
+// base64Cleaner strips whitespace that base64.NewDecoder does not tolerate.
+// The standard decoder only skips CR and LF, but mailers commonly emit
+// trailing spaces or tabs on encoded lines.
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	for {
+		n, err := c.r.Read(p)
+		j := 0
+		for _, b := range p[:n] {
+			if b != ' ' && b != '\t' {
+				p[j] = b
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+// uuDecoder decodes uuencoded data line by line.
+type uuDecoder struct {
+	scanner *bufio.Scanner
+	started bool
+	done    bool
+	buf     []byte
+}
+
+func newUUDecoder(r io.Reader) *uuDecoder {
+	return &uuDecoder{scanner: bufio.NewScanner(r)}
+}
+
+func (d *uuDecoder) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.decodeLine(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// decodeLine decodes the next line of input into d.buf.
+func (d *uuDecoder) decodeLine() error {
+	if !d.scanner.Scan() {
+		if err := d.scanner.Err(); err != nil {
+			return err
+		}
+		if !d.started {
+			return fmt.Errorf("uuencode: missing begin line")
+		}
+		d.done = true
+		return nil
+	}
+	line := bytes.TrimRight(d.scanner.Bytes(), "\r")
+
+	if !d.started {
+		// Skip any preamble before the begin line
+		if bytes.HasPrefix(line, []byte("begin ")) {
+			d.started = true
+		}
+		return nil
+	}
+	if bytes.Equal(bytes.TrimSpace(line), []byte("end")) || len(line) == 0 {
+		d.done = true
+		return nil
+	}
+
+	n := int((line[0] - ' ') & 0x3f)
+	if n == 0 {
+		// Zero-length line precedes "end"
+		return nil
+	}
+
+	out := make([]byte, 0, n+2)
+	for i := 1; len(out) < n; i += 4 {
+		var c [4]byte
+		for j := range c {
+			if i+j < len(line) {
+				c[j] = (line[i+j] - ' ') & 0x3f
+			}
+		}
+		out = append(out,
+			c[0]<<2|c[1]>>4,
+			c[1]<<4|c[2]>>2,
+			c[2]<<6|c[3],
+		)
+	}
+	d.buf = out[:n]
+	return nil
+}
+
+// wordDecoder decodes RFC 2047 encoded-words in any charset known to
+// go-message, not just UTF-8 and ISO-8859-1.
+var wordDecoder = &mime.WordDecoder{CharsetReader: charset.Reader}
+
+// decodeParam returns the value of the MIME parameter name, reassembling
+// RFC 2231 continuations and converting their charset to UTF-8, as in:
+//
+//	filename*0*=utf-8''%D1%84%D0%BE; filename*1*=%D1%82%D0%BE; filename*2=.jpg
+//
+// Only the extended segments, marked by a trailing *, are percent-decoded.
+// Plain values are expected to have had their RFC 2047 encoded-words decoded
+// already.
+func decodeParam(params map[string]string, name string) string {
+	name = strings.ToLower(name)
+	if v, ok := params[name+"*"]; ok {
+		return decodeExtValue(v)
+	}
+
+	var (
+		raw   []byte
+		cs    string
+		found bool
+	)
+	for i := 0; ; i++ {
+		key := name + "*" + strconv.Itoa(i)
+		if v, ok := params[key+"*"]; ok {
+			// Only the first segment starts with charset'language'
+			if i == 0 {
+				if c, encoded, ok := cutExtPrefix(v); ok {
+					cs, v = c, encoded
+				}
+			}
+			raw = append(raw, percentDecode(v)...)
+		} else if v, ok := params[key]; ok {
+			raw = append(raw, v...)
+		} else {
+			break
+		}
+		found = true
+	}
+	if found {
+		return convertCharset(cs, raw)
+	}
+	return params[name]
+}
+
+// decodeExtValue decodes an RFC 2231 extended value, charset'language'
+// followed by percent-encoded bytes. It returns the value unchanged if it
+// can't be decoded.
+func decodeExtValue(v string) string {
+	cs, encoded, ok := cutExtPrefix(v)
+	if !ok {
+		return v
+	}
+	return convertCharset(cs, percentDecode(encoded))
+}
+
+// cutExtPrefix splits an RFC 2231 extended value into its charset and the
+// encoded value after the language.
+func cutExtPrefix(v string) (cs, encoded string, ok bool) {
+	cs, rest, ok := strings.Cut(v, "'")
+	if !ok {
+		return "", v, false
+	}
+	_, encoded, ok = strings.Cut(rest, "'")
+	if !ok {
+		return "", v, false
+	}
+	return cs, encoded, true
+}
+
+// percentDecode decodes the %XX escapes in s. A % that doesn't start an
+// escape is kept as it is.
+func percentDecode(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(n))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
+
+// convertCharset converts raw from the charset cs to UTF-8. It returns raw
+// as it is if the charset is unknown.
+func convertCharset(cs string, raw []byte) string {
+	switch strings.ToLower(cs) {
+	case "", "utf-8", "us-ascii":
+		return string(raw)
+	}
+	r, err := charset.Reader(cs, bytes.NewReader(raw))
+	if err != nil {
+		return string(raw)
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return string(raw)
+	}
+	return string(decoded)
+}
+
+// normalizeText normalizes a decoded header value to NFC, so that names
+// written on systems that decompose accents, like macOS, compare and display
+// the same as everywhere else.
+func normalizeText(s string) string {
+	return norm.NFC.String(s)
+}
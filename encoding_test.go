@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTransferEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		input    string
+		want     string
+	}{
+		{"empty encoding", "", "raw bytes", "raw bytes"},
+		{"7bit", "7bit", "plain text", "plain text"},
+		{"8bit", "8BIT", "caf\xc3\xa9", "caf\xc3\xa9"},
+		{"binary", "binary", "\xff\xd8\xff\xe0", "\xff\xd8\xff\xe0"},
+		{"base64", "base64", "/9j/4AAQ", "\xff\xd8\xff\xe0\x00\x10"},
+		{"base64 with line breaks", "BASE64", "aGVs\r\nbG8g\r\nd29y\r\nbGQ=\r\n", "hello world"},
+		{"base64 with trailing spaces", "base64", "aGVsbG8g \r\nd29ybGQ=\t\r\n", "hello world"},
+		{"quoted-printable", "quoted-printable", "caf=C3=A9 =\r\nlatte", "caf\xc3\xa9 latte"},
+		{"uuencode", "x-uuencode", "begin 644 hello.txt\n+:&5L;&\\@=V]R;&0`\n`\nend\n", "hello world"},
+		{"uuencode with preamble", "x-uue", "some text\r\nbegin 644 a.bin\r\n#04)#\r\n`\r\nend\r\n", "ABC"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := decodeTransferEncoding(strings.NewReader(tt.input), tt.encoding)
+			if err != nil {
+				t.Fatalf("decodeTransferEncoding failed: %v", err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("reading decoded data: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, string(got))
+			}
+		})
+	}
+}
+
+func TestDecodeTransferEncoding_Unsupported(t *testing.T) {
+	_, err := decodeTransferEncoding(strings.NewReader("data"), "x-custom")
+	if err == nil {
+		t.Error("expected error for unsupported encoding, got nil")
+	}
+}
+
+func TestDecodeTransferEncoding_InvalidBase64(t *testing.T) {
+	r, err := decodeTransferEncoding(strings.NewReader("not*valid*base64"), "base64")
+	if err != nil {
+		t.Fatalf("decodeTransferEncoding failed: %v", err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("expected error reading invalid base64, got nil")
+	}
+}
+
+func TestDecodeTransferEncoding_UUEncodeMissingBegin(t *testing.T) {
+	r, err := decodeTransferEncoding(strings.NewReader("#04)#\nend\n"), "x-uuencode")
+	if err != nil {
+		t.Fatalf("decodeTransferEncoding failed: %v", err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("expected error for missing begin line, got nil")
+	}
+}
+
+func TestDecodeParam(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		want   string
+	}{
+		{"plain", map[string]string{"filename": "photo.jpg"}, "photo.jpg"},
+		{"extended", map[string]string{"filename*": "utf-8''%D1%84%D0%BE%D1%82%D0%BE.jpg"}, "фото.jpg"},
+		{"extended with language", map[string]string{"filename*": "UTF-8'ru'%D1%84%D0%BE%D1%82%D0%BE.jpg"}, "фото.jpg"},
+		{"extended charset", map[string]string{"filename*": "shift_jis''%8E%CA%90%5E.jpg"}, "写真.jpg"},
+		{"continuations", map[string]string{
+			"filename*0*": "utf-8''%D1%84%D0%BE",
+			"filename*1*": "%D1%82%D0%BE",
+			"filename*2":  ".jpg",
+		}, "фото.jpg"},
+		{"plain continuations", map[string]string{"filename*0": "long-", "filename*1": "name.jpg"}, "long-name.jpg"},
+		{"literal percent", map[string]string{
+			"filename*0*": "utf-8''%D1%84%D0%BE%D1%82%D0%BE",
+			"filename*1":  " 100%25.jpg",
+		}, "фото 100%25.jpg"},
+		{"extended after plain", map[string]string{
+			"filename*0":  "photo ",
+			"filename*1*": "%E2%84%96%201.jpg",
+		}, "photo № 1.jpg"},
+		{"extended charset continuations", map[string]string{
+			"filename*0*": "shift_jis''%8E%CA",
+			"filename*1*": "%90%5E.jpg",
+		}, "写真.jpg"},
+		{"stray percent", map[string]string{"filename*": "utf-8''100%.jpg"}, "100%.jpg"},
+		{"extended preferred", map[string]string{"filename": "fallback.jpg", "filename*": "utf-8''real.jpg"}, "real.jpg"},
+		{"malformed", map[string]string{"filename*": "no-quotes.jpg"}, "no-quotes.jpg"},
+		{"missing", map[string]string{"name": "other.jpg"}, ""},
+	}
+	for _, tt := range tests {
+		if got := decodeParam(tt.params, "filename"); got != tt.want {
+			t.Errorf("%s: decodeParam() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWordDecoder(t *testing.T) {
+	tests := map[string]string{
+		"=?UTF-8?B?0YTQvtGC0L4uanBn?=":       "фото.jpg",
+		"=?ISO-2022-JP?B?GyRCPEw/PxsoQg==?=": "写真",
+		"=?KOI8-R?B?xs/Uzy5qcGc=?=":          "фото.jpg",
+		"plain.jpg":                          "plain.jpg",
+	}
+	for encoded, want := range tests {
+		got, err := wordDecoder.DecodeHeader(encoded)
+		if err != nil || got != want {
+			t.Errorf("DecodeHeader(%q) = %q, %v, want %q", encoded, got, err, want)
+		}
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	if got := normalizeText("café.jpg"); got != "café.jpg" {
+		t.Errorf("expected a decomposed name to be composed, got %q", got)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// expandEnvNode replaces ${VAR} and ${VAR:-default} references in the scalar
+// values of a parsed YAML document with the values of environment variables.
+// "$${" produces a literal "${". Mapping keys are left alone, as are the
+// values of the top-level keys in skip, which are expanded separately if they
+// are used at all. It is an error to reference a variable that isn't set,
+// unless a default is given.
+func expandEnvNode(node *yaml.Node, skip ...string) error {
+	var undefined []string
+	walk := walkScalarValues
+	if len(skip) > 0 {
+		walk = func(node *yaml.Node, fn func(*yaml.Node)) {
+			root := node
+			if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+				root = root.Content[0]
+			}
+			if root.Kind != yaml.MappingNode {
+				walkScalarValues(node, fn)
+				return
+			}
+			for i := 0; i+1 < len(root.Content); i += 2 {
+				if !slices.Contains(skip, root.Content[i].Value) {
+					walkScalarValues(root.Content[i+1], fn)
+				}
+			}
+		}
+	}
+	walk(node, func(n *yaml.Node) {
+		value, missing := expandEnv(n.Value)
+		if value == n.Value {
+			return
+		}
+		n.Value = value
+		// Let plain scalars like port: ${PORT} resolve to their real type,
+		// but not to null, which would turn a value such as ~ into ""
+		if n.Style == 0 {
+			n.Tag = ""
+			if isYAMLNull(value) && value != "" {
+				n.Tag = "!!str"
+			}
+		}
+		for _, name := range missing {
+			if !slices.Contains(undefined, name) {
+				undefined = append(undefined, name)
+			}
+		}
+	})
+	if len(undefined) > 0 {
+		return fmt.Errorf("undefined environment variables: %s", strings.Join(undefined, ", "))
+	}
+	return nil
+}
+
+// isYAMLNull reports whether a plain scalar with the given value is null.
+func isYAMLNull(value string) bool {
+	switch value {
+	case "", "~", "null", "Null", "NULL":
+		return true
+	}
+	return false
+}
+
+// walkScalarValues calls fn for every scalar below node that isn't a mapping
+// key.
+func walkScalarValues(node *yaml.Node, fn func(*yaml.Node)) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			walkScalarValues(child, fn)
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			walkScalarValues(node.Content[i], fn)
+		}
+	case yaml.ScalarNode:
+		fn(node)
+	}
+}
+
+// expandEnv expands the variable references in s. It returns the names of
+// referenced variables that aren't set and have no default.
+func expandEnv(s string) (string, []string) {
+	var b strings.Builder
+	var missing []string
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		if i > 0 && s[i-1] == '$' {
+			// Escaped as $${
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+
+		ref := s[i+2 : i+end]
+		name, def, hasDefault := strings.Cut(ref, ":-")
+		value, ok := os.LookupEnv(name)
+		switch {
+		case ok && (value != "" || !hasDefault):
+			b.WriteString(value)
+		case hasDefault:
+			b.WriteString(def)
+		default:
+			missing = append(missing, name)
+		}
+		s = s[i+end+1:]
+	}
+	return b.String(), missing
+}
+
+// expandHome replaces a leading ~ in path with the user's home directory.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// expandPaths expands a leading ~ in the settings that are file paths.
+func (c *Config) expandPaths() {
+	for _, path := range []*string{
+		&c.Output,
+		&c.JSONOutput,
+		&c.StateFile,
+		&c.PasswordFile,
+		&c.OAuth2TokenCache,
+		&c.TLSCAFile,
+		&c.TLSCertFile,
+		&c.TLSKeyFile,
+	} {
+		*path = expandHome(*path)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("MAILGRAB_TEST_USER", "alice")
+	t.Setenv("MAILGRAB_TEST_EMPTY", "")
+
+	tests := []struct {
+		in          string
+		want        string
+		wantMissing []string
+	}{
+		{"plain", "plain", nil},
+		{"${MAILGRAB_TEST_USER}", "alice", nil},
+		{"/home/${MAILGRAB_TEST_USER}/Pictures", "/home/alice/Pictures", nil},
+		{"${MAILGRAB_TEST_USER}@${MAILGRAB_TEST_USER}", "alice@alice", nil},
+		{"${MAILGRAB_TEST_UNSET:-fallback}", "fallback", nil},
+		{"${MAILGRAB_TEST_USER:-fallback}", "alice", nil},
+		{"${MAILGRAB_TEST_EMPTY:-fallback}", "fallback", nil},
+		{"${MAILGRAB_TEST_EMPTY}", "", nil},
+		{"${MAILGRAB_TEST_UNSET}", "", []string{"MAILGRAB_TEST_UNSET"}},
+		{"pa$$${MAILGRAB_TEST_USER}", "pa$${MAILGRAB_TEST_USER}", nil},
+		{"pa$$word", "pa$$word", nil},
+		{"$HOME", "$HOME", nil},
+		{"${unterminated", "${unterminated", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, missing := expandEnv(tt.in)
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+			if !slices.Equal(missing, tt.wantMissing) {
+				t.Errorf("expected missing %v, got %v", tt.wantMissing, missing)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile_EnvExpansion(t *testing.T) {
+	t.Setenv("MAILGRAB_TEST_PASSWORD", "s3cret")
+	t.Setenv("MAILGRAB_TEST_PORT", "1993")
+	t.Setenv("MAILGRAB_TEST_DIR", "/srv/mail")
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configContent := `server: imap.example.com
+port: ${MAILGRAB_TEST_PORT}
+password: ${MAILGRAB_TEST_PASSWORD}
+output: ${MAILGRAB_TEST_DIR}/photos
+mailbox: ${MAILGRAB_TEST_MAILBOX:-INBOX}
+mailboxes:
+  - ${MAILGRAB_TEST_MAILBOX:-INBOX}
+accounts:
+  - name: ${MAILGRAB_TEST_DIR}
+    username: ${MAILGRAB_TEST_PASSWORD}
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	cfg := &Config{}
+	if err := loadConfigFile(configPath, cfg); err != nil {
+		t.Fatalf("loadConfigFile failed: %v", err)
+	}
+	if cfg.Port != 1993 {
+		t.Errorf("expected port 1993, got %d", cfg.Port)
+	}
+	if cfg.Password != "s3cret" {
+		t.Errorf("expected expanded password, got %q", cfg.Password)
+	}
+	if cfg.Output != "/srv/mail/photos" {
+		t.Errorf("expected output /srv/mail/photos, got %q", cfg.Output)
+	}
+	if cfg.Mailbox != "INBOX" || !slices.Equal(cfg.Mailboxes, []string{"INBOX"}) {
+		t.Errorf("expected default mailbox INBOX, got %q and %v", cfg.Mailbox, cfg.Mailboxes)
+	}
+	if len(cfg.Accounts) != 1 || cfg.Accounts[0].Name != "/srv/mail" || cfg.Accounts[0].Username != "s3cret" {
+		t.Errorf("expected variables in accounts to be expanded, got %+v", cfg.Accounts)
+	}
+}
+
+func TestLoadConfigFile_EnvExpansionNull(t *testing.T) {
+	t.Setenv("MAILGRAB_TEST_DIR", "~")
+	t.Setenv("MAILGRAB_TEST_PASSWORD", "null")
+	t.Setenv("MAILGRAB_TEST_PORT", "")
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configContent := `output: ${MAILGRAB_TEST_DIR}
+password: ${MAILGRAB_TEST_PASSWORD}
+port: ${MAILGRAB_TEST_PORT}
+mailbox: ~
+json_output: null
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	cfg := &Config{Mailbox: "INBOX"}
+	if err := loadConfigFile(configPath, cfg); err != nil {
+		t.Fatalf("loadConfigFile failed: %v", err)
+	}
+	// Values from the environment are kept as they are
+	if cfg.Output != "~" || cfg.Password != "null" {
+		t.Errorf("expected output ~ and password null, got %q and %q", cfg.Output, cfg.Password)
+	}
+	// Null values in the file, and empty ones from the environment, are
+	// still null
+	if cfg.Port != 0 || cfg.Mailbox != "INBOX" || cfg.JSONOutput != "" {
+		t.Errorf("expected null values to leave settings unchanged, got %+v", cfg)
+	}
+}
+
+func TestLoadConfigFile_UndefinedVariables(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configContent := `password: ${MAILGRAB_TEST_UNSET_A}
+output: ${MAILGRAB_TEST_UNSET_B}/${MAILGRAB_TEST_UNSET_A}
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	err := loadConfigFile(configPath, &Config{})
+	want := "undefined environment variables: MAILGRAB_TEST_UNSET_A, MAILGRAB_TEST_UNSET_B"
+	if err == nil || err.Error() != want {
+		t.Errorf("expected error %q, got %v", want, err)
+	}
+}
+
+func TestLoadConfig_UnselectedVariables(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configContent := `server: imap.example.com
+username: me@example.com
+password: pass
+output: /photos
+profiles:
+  work:
+    password: ${MAILGRAB_TEST_UNSET_WORK}
+  family:
+    output: /family
+    accounts:
+      - name: kids
+      - name: other
+        password: ${MAILGRAB_TEST_UNSET_OTHER}
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	// Variables of profiles and accounts that aren't selected needn't be
+	// set
+	cfg, err := loadConfig([]string{"-c", configPath, "--profile", "family", "--account", "kids"}, nil)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if len(cfg.Accounts) != 1 || cfg.Accounts[0].Output != "/family" {
+		t.Errorf("expected the kids account of the family profile, got %+v", cfg.Accounts)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--profile", "work"}, "profile work: undefined environment variables: MAILGRAB_TEST_UNSET_WORK"},
+		{[]string{"--profile", "family"}, "account other: undefined environment variables: MAILGRAB_TEST_UNSET_OTHER"},
+	} {
+		_, err := loadConfig(append([]string{"-c", configPath}, tt.args...), nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: expected error %q, got %v", tt.args, tt.want, err)
+		}
+	}
+}
+
+func TestExpandPaths(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	cfg := &Config{
+		Output:     "~/Pictures/mail",
+		JSONOutput: "~",
+		StateFile:  "/var/lib/mailgrab/state.json",
+		TLSCAFile:  "~other/ca.pem",
+	}
+	cfg.expandPaths()
+
+	if want := filepath.Join(home, "Pictures", "mail"); cfg.Output != want {
+		t.Errorf("expected output %q, got %q", want, cfg.Output)
+	}
+	if cfg.JSONOutput != home {
+		t.Errorf("expected json_output %q, got %q", home, cfg.JSONOutput)
+	}
+	if cfg.StateFile != "/var/lib/mailgrab/state.json" {
+		t.Errorf("expected absolute state_file to be unchanged, got %q", cfg.StateFile)
+	}
+	if cfg.TLSCAFile != "~other/ca.pem" {
+		t.Errorf("expected ~user path to be unchanged, got %q", cfg.TLSCAFile)
+	}
+}
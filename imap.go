@@ -1,11 +1,16 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
@@ -13,15 +18,48 @@ import (
 
 const seenKeyword imap.Flag = "mailgrab-seen"
 
+type SecurityMode string
+
+const (
+	SecurityTLS      SecurityMode = "tls"
+	SecurityStartTLS SecurityMode = "starttls"
+	SecurityNone     SecurityMode = "none"
+)
+
+// defaultPort returns the standard IMAP port for a security mode.
+func defaultPort(security SecurityMode) int {
+	if security == SecurityTLS || security == "" {
+		return 993
+	}
+	return 143
+}
+
+// isLoopbackHost reports whether host refers to the local machine, where a
+// plaintext connection can't be observed on the network.
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// idleTimeout is how long a single IDLE command is left running before it is
+// re-issued. Servers may drop idle clients after 30 minutes (RFC 2177).
+const idleTimeout = 25 * time.Minute
+
 // IMAPClient defines the interface for IMAP operations, enabling testing.
 type IMAPClient interface {
 	Login(username, password string) *imapclient.Command
 	Select(mailbox string, options *imap.SelectOptions) *imapclient.SelectCommand
-	Search(criteria *imap.SearchCriteria, options *imap.SearchOptions) *imapclient.SearchCommand
+	List(ref, pattern string, options *imap.ListOptions) *imapclient.ListCommand
+	UIDSearch(criteria *imap.SearchCriteria, options *imap.SearchOptions) *imapclient.SearchCommand
 	Fetch(numSet imap.NumSet, options *imap.FetchOptions) *imapclient.FetchCommand
 	Store(numSet imap.NumSet, store *imap.StoreFlags, options *imap.StoreOptions) *imapclient.FetchCommand
 	Move(numSet imap.NumSet, mailbox string) *imapclient.MoveCommand
 	UIDExpunge(uids imap.UIDSet) *imapclient.ExpungeCommand
+	Idle() (*imapclient.IdleCommand, error)
+	Caps() imap.CapSet
 	Logout() *imapclient.Command
 	Close() error
 }
@@ -31,6 +69,8 @@ type Message struct {
 	UID         imap.UID
 	Subject     string
 	From        string
+	Date        time.Time
+	MessageID   string
 	Attachments []Attachment
 }
 
@@ -39,151 +79,402 @@ type MailClient struct {
 	client  IMAPClient
 	cfg     *Config
 	verbose func(string, ...any)
+	updates chan struct{}
+	// tlsConfig is used for TLS and STARTTLS connections; nil means defaults
+	tlsConfig *tls.Config
+
+	// Local state tracking for the selected mailbox, used instead of the
+	// mailgrab-seen keyword when useState is set
+	state       *StateStore
+	useState    bool
+	stateKey    string
+	uidValidity uint32
 }
 
 // NewMailClient creates a new MailClient connected to the IMAP server.
 func NewMailClient(cfg *Config, verbose func(string, ...any)) (*MailClient, error) {
-	var client *imapclient.Client
-	var err error
-
-	addr := fmt.Sprintf("%s:%d", cfg.Server, cfg.Port)
+	m := &MailClient{
+		cfg:     cfg,
+		verbose: verbose,
+		updates: make(chan struct{}, 1),
+	}
 
-	options := &imapclient.Options{}
-	if cfg.Insecure {
-		options.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	tlsConfig, err := buildTLSConfig(cfg)
+	if err != nil {
+		return nil, err
 	}
+	m.tlsConfig = tlsConfig
+
+	addr := net.JoinHostPort(cfg.Server, strconv.Itoa(cfg.Port))
 
 	verbose("Connecting to %s...", addr)
-	client, err = imapclient.DialTLS(addr, options)
+	client, err := m.dial(addr)
 	if err != nil {
 		return nil, fmt.Errorf("connecting to server: %w", err)
 	}
 
 	verbose("Authenticating as %s...", cfg.Username)
-	if err := client.Login(cfg.Username, cfg.Password).Wait(); err != nil {
+	if err := m.authenticate(client); err != nil {
 		_ = client.Close()
 		return nil, fmt.Errorf("authentication failed: %w", err)
 	}
 
-	return &MailClient{
-		client:  client,
-		cfg:     cfg,
-		verbose: verbose,
-	}, nil
+	m.client = client
+	return m, nil
+}
+
+// dial connects to addr using the configured security mode.
+func (m *MailClient) dial(addr string) (*imapclient.Client, error) {
+	switch m.cfg.Security {
+	case SecurityStartTLS:
+		return imapclient.DialStartTLS(addr, m.clientOptions())
+	case SecurityNone:
+		m.verbose("Warning: connecting without TLS, credentials are sent in plaintext")
+		return imapclient.DialInsecure(addr, m.clientOptions())
+	default:
+		return imapclient.DialTLS(addr, m.clientOptions())
+	}
 }
 
-// FetchNewMessages fetches all messages that haven't been processed yet.
-func (m *MailClient) FetchNewMessages() ([]Message, error) {
-	m.verbose("Selecting mailbox: %s", m.cfg.Mailbox)
-	if _, err := m.client.Select(m.cfg.Mailbox, nil).Wait(); err != nil {
-		return nil, fmt.Errorf("selecting mailbox: %w", err)
+// authenticate logs in with a password or, for the OAuth2 auth methods,
+// with an access token over SASL.
+func (m *MailClient) authenticate(client *imapclient.Client) error {
+	switch m.cfg.Auth {
+	case AuthXOAuth2, AuthOAuthBearer:
+		token, err := NewTokenSource(m.cfg).Token()
+		if err != nil {
+			return err
+		}
+		m.verbose("Using %s", strings.ToUpper(string(m.cfg.Auth)))
+		return client.Authenticate(newOAuthSASLClient(m.cfg, token.AccessToken))
+	default:
+		return client.Login(m.cfg.Username, m.cfg.Password).Wait()
 	}
+}
 
-	// Search for messages without our custom keyword
-	criteria := &imap.SearchCriteria{
-		NotFlag: []imap.Flag{seenKeyword},
+// clientOptions returns the imapclient options for connecting to the server.
+func (m *MailClient) clientOptions() *imapclient.Options {
+	options := &imapclient.Options{
+		WordDecoder: wordDecoder,
+		UnilateralDataHandler: &imapclient.UnilateralDataHandler{
+			Mailbox: func(data *imapclient.UnilateralDataMailbox) {
+				if data.NumMessages != nil {
+					m.notifyUpdate()
+				}
+			},
+		},
 	}
-	searchData, err := m.client.Search(criteria, nil).Wait()
-	if err != nil {
-		return nil, fmt.Errorf("searching messages: %w", err)
+	if m.tlsConfig != nil {
+		options.TLSConfig = m.tlsConfig.Clone()
 	}
+	return options
+}
 
-	seqNums := searchData.AllSeqNums()
-	if len(seqNums) == 0 {
-		m.verbose("No new messages found")
-		return nil, nil
+// notifyUpdate records that the selected mailbox changed without blocking the
+// connection's reader.
+func (m *MailClient) notifyUpdate() {
+	select {
+	case m.updates <- struct{}{}:
+	default:
 	}
-	m.verbose("Found %d new message(s)", len(seqNums))
+}
 
-	seqSet := imap.SeqSetNum(seqNums...)
-	fetchOptions := &imap.FetchOptions{
-		UID:           true,
-		Envelope:      true,
-		BodyStructure: &imap.FetchItemBodyStructure{},
+// Capabilities returns the capabilities advertised by the server, sorted.
+func (m *MailClient) Capabilities() []string {
+	var caps []string
+	for capability := range m.client.Caps() {
+		caps = append(caps, string(capability))
 	}
+	slices.Sort(caps)
+	return caps
+}
 
-	fetchCmd := m.client.Fetch(seqSet, fetchOptions)
-	defer func() { _ = fetchCmd.Close() }()
+// Examine opens mailbox read-only and returns its status.
+func (m *MailClient) Examine(mailbox string) (*imap.SelectData, error) {
+	return m.client.Select(mailbox, &imap.SelectOptions{ReadOnly: true}).Wait()
+}
 
-	var messages []Message
-	for {
-		msg := fetchCmd.Next()
-		if msg == nil {
-			break
+// MailboxExists reports whether a mailbox with the given name exists.
+func (m *MailClient) MailboxExists(mailbox string) (bool, error) {
+	listed, err := m.client.List("", mailbox, nil).Collect()
+	if err != nil {
+		return false, err
+	}
+	for _, data := range listed {
+		if data.Mailbox == mailbox && !slices.Contains(data.Attrs, imap.MailboxAttrNonExistent) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isMailboxPattern reports whether name contains LIST wildcards.
+func isMailboxPattern(name string) bool {
+	return strings.ContainsAny(name, "*%")
+}
+
+// ResolveMailboxes expands the configured mailboxes into the names of
+// mailboxes to check. Names containing the LIST wildcards * or % are
+// expanded with the LIST command, skipping mailboxes that can't be selected
+// and the move_to and rejected_move_to targets; other names are used as
+// given. Duplicates are removed.
+func (m *MailClient) ResolveMailboxes() ([]string, error) {
+	var mailboxes []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			mailboxes = append(mailboxes, name)
 		}
+	}
 
-		var uid imap.UID
-		var subject string
-		var from string
-		var bodyStructure imap.BodyStructure
+	for _, name := range m.cfg.MailboxList() {
+		if !isMailboxPattern(name) {
+			add(name)
+			continue
+		}
 
-		for {
-			item := msg.Next()
-			if item == nil {
-				break
+		listed, err := m.client.List("", name, nil).Collect()
+		if err != nil {
+			return nil, fmt.Errorf("listing mailboxes matching %s: %w", name, err)
+		}
+		matched := 0
+		for _, data := range listed {
+			if slices.Contains(data.Attrs, imap.MailboxAttrNoSelect) || slices.Contains(data.Attrs, imap.MailboxAttrNonExistent) {
+				continue
 			}
-			switch data := item.(type) {
-			case imapclient.FetchItemDataUID:
-				uid = data.UID
-			case imapclient.FetchItemDataEnvelope:
-				subject = data.Envelope.Subject
-				if len(data.Envelope.From) > 0 {
-					addr := data.Envelope.From[0]
-					from = addr.Mailbox + "@" + addr.Host
-				}
-			case imapclient.FetchItemDataBodyStructure:
-				bodyStructure = data.BodyStructure
+			if m.cfg.PostAction == PostActionMove && data.Mailbox == m.cfg.MoveTo {
+				continue
+			}
+			if m.cfg.RejectedAction == PostActionMove && data.Mailbox == m.cfg.RejectedMoveTo {
+				continue
 			}
+			add(data.Mailbox)
+			matched++
 		}
+		m.verbose("Mailbox pattern %s matched %d mailbox(es)", name, matched)
+	}
 
-		var attachments []Attachment
-		if bodyStructure != nil {
-			var err error
-			attachments, err = m.fetchAttachments(uid, bodyStructure)
-			if err != nil {
-				return nil, fmt.Errorf("fetching attachments for UID %d: %w", uid, err)
-			}
+	return mailboxes, nil
+}
+
+// ForEachNewMessage selects mailbox, searches it for messages that haven't
+// been processed yet and calls fn for each of them in turn. A message is only
+// fetched once fn has returned for the previous one, so each message can be
+// saved, flagged and post-actioned before the next is downloaded. Iteration
+// stops when fn returns an error or, between messages, when ctx is cancelled.
+func (m *MailClient) ForEachNewMessage(ctx context.Context, mailbox string, fn func(Message) error) error {
+	m.verbose("Selecting mailbox: %s", mailbox)
+	// Dry runs examine the mailbox so that messages don't lose \Recent
+	var options *imap.SelectOptions
+	if m.cfg.DryRun {
+		options = &imap.SelectOptions{ReadOnly: true}
+	}
+	selectData, err := m.client.Select(mailbox, options).Wait()
+	if err != nil {
+		return fmt.Errorf("selecting mailbox %s: %w", mailbox, err)
+	}
+	if err := m.setupState(mailbox, selectData); err != nil {
+		return err
+	}
+
+	// Search for messages matching the configured criteria that don't have
+	// our custom keyword, or all that match when processed ones are tracked
+	// locally
+	criteria := m.cfg.searchCriteria(time.Now())
+	if !m.useState {
+		criteria.NotFlag = append(criteria.NotFlag, seenKeyword)
+	}
+	// Leave out messages from senders that aren't allowed, unless they have a
+	// rejected_action to be applied to
+	if m.cfg.RejectedAction == PostActionNone || m.cfg.RejectedAction == "" {
+		if senders := senderSearchCriteria(m.cfg.AllowSenders); senders != nil {
+			criteria.And(senders)
 		}
+	}
+	searchData, err := m.client.UIDSearch(criteria, nil).Wait()
+	if err != nil {
+		return fmt.Errorf("searching messages: %w", err)
+	}
 
-		messages = append(messages, Message{
-			UID:         uid,
-			Subject:     subject,
-			From:        from,
-			Attachments: attachments,
+	uids := searchData.AllUIDs()
+	if m.useState {
+		uids = slices.DeleteFunc(uids, func(uid imap.UID) bool {
+			return m.state.IsProcessed(m.stateKey, m.uidValidity, uid)
 		})
 	}
+	if len(uids) == 0 {
+		m.verbose("No new messages found")
+		return nil
+	}
+	m.verbose("Found %d new message(s)", len(uids))
+
+	for _, uid := range uids {
+		if ctx.Err() != nil {
+			m.verbose("Interrupted, stopping before message %d", uid)
+			return nil
+		}
+
+		msg, err := m.fetchMessage(uid)
+		if err != nil {
+			return fmt.Errorf("fetching message %d: %w", uid, err)
+		}
+		if msg == nil {
+			// Expunged since the search
+			continue
+		}
+
+		if err := fn(*msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setupState decides whether processed messages in the selected mailbox are
+// tracked with the mailgrab-seen keyword or in the local state file.
+func (m *MailClient) setupState(mailbox string, data *imap.SelectData) error {
+	switch m.cfg.State {
+	case StateKeyword:
+		m.useState = false
+	case StateFile:
+		m.useState = true
+	default:
+		if m.cfg.DryRun {
+			// Examined mailboxes have no permanent flags, so the state file
+			// is used if earlier runs tracked the mailbox in it
+			if err := m.loadState(); err != nil {
+				return err
+			}
+			m.useState = m.state.Tracks(stateKey(m.cfg.Username, m.cfg.Server, mailbox))
+			break
+		}
+		m.useState = !canStoreKeyword(data.PermanentFlags)
+		if m.useState {
+			m.verbose("Server can't store the %s keyword, tracking processed messages in %s", seenKeyword, m.cfg.StateFile)
+		}
+	}
+	if !m.useState {
+		return nil
+	}
+
+	if err := m.loadState(); err != nil {
+		return err
+	}
 
-	return messages, nil
+	m.stateKey = stateKey(m.cfg.Username, m.cfg.Server, mailbox)
+	m.uidValidity = data.UIDValidity
+	if n := m.state.CheckUIDValidity(m.stateKey, m.uidValidity); n > 0 {
+		m.verbose("UIDVALIDITY of %s changed, forgetting %d processed message(s)", mailbox, n)
+	}
+
+	return nil
 }
 
-// fetchAttachments fetches attachment data from a message.
-func (m *MailClient) fetchAttachments(uid imap.UID, bs imap.BodyStructure) ([]Attachment, error) {
-	parts := findAttachmentParts(bs, nil)
-	if len(parts) == 0 {
-		return nil, nil
+// loadState loads the state file, unless it has been already.
+func (m *MailClient) loadState() error {
+	if m.state != nil {
+		return nil
+	}
+	state, err := m.cfg.loadStateStore()
+	if err != nil {
+		return err
 	}
+	m.state = state
+	return nil
+}
 
-	var attachments []Attachment
-	for _, part := range parts {
-		att, err := m.fetchPart(uid, part)
+// fetchMessage fetches the envelope and body structure of a single message.
+// It returns nil if the message no longer exists.
+func (m *MailClient) fetchMessage(uid imap.UID) (*Message, error) {
+	fetchOptions := &imap.FetchOptions{
+		UID:           true,
+		Envelope:      true,
+		BodyStructure: &imap.FetchItemBodyStructure{},
+	}
+
+	fetchCmd := m.client.Fetch(imap.UIDSetNum(uid), fetchOptions)
+
+	data := fetchCmd.Next()
+	if data == nil {
+		return nil, fetchCmd.Close()
+	}
+
+	msg := &Message{UID: uid}
+	var bodyStructure imap.BodyStructure
+	for {
+		item := data.Next()
+		if item == nil {
+			break
+		}
+		switch data := item.(type) {
+		case imapclient.FetchItemDataEnvelope:
+			msg.Subject = normalizeText(data.Envelope.Subject)
+			msg.Date = data.Envelope.Date
+			msg.MessageID = data.Envelope.MessageID
+			if len(data.Envelope.From) > 0 {
+				addr := data.Envelope.From[0]
+				msg.From = addr.Mailbox + "@" + addr.Host
+			}
+		case imapclient.FetchItemDataBodyStructure:
+			bodyStructure = data.BodyStructure
+		}
+	}
+
+	if err := fetchCmd.Close(); err != nil {
+		return nil, err
+	}
+
+	if bodyStructure != nil {
+		parts, err := m.selectInlineParts(uid, bodyStructure, findAttachmentParts(bodyStructure, nil))
 		if err != nil {
 			return nil, err
 		}
-		if att != nil {
-			attachments = append(attachments, *att)
-		}
+		msg.Attachments = newAttachments(uid, parts)
 	}
+	return msg, nil
+}
 
-	return attachments, nil
+// newAttachments converts attachment parts found in a body structure into
+// Attachments. Their data is fetched later with StreamAttachment.
+func newAttachments(uid imap.UID, parts []attachmentPart) []Attachment {
+	var attachments []Attachment
+	for i, part := range parts {
+		filename := part.filename
+		if filename == "" {
+			filename = inlineFilename(uid, part)
+		}
+		attachments = append(attachments, Attachment{
+			Filename: filename,
+			MIMEType: part.mimeType,
+			Index:    i + 1,
+			Part:     part.path,
+			Encoding: part.encoding,
+			Size:     part.size,
+
+			MaybeShown: part.maybeShown,
+		})
+	}
+	return attachments
 }
 
 type attachmentPart struct {
 	path     []int
 	mimeType string
 	filename string
+	encoding string
+	size     int64
+	// contentID and description are the part's Content-ID, without angle
+	// brackets, and Content-Description.
+	contentID   string
+	description string
+	// maybeShown is set in dry runs, see Attachment.MaybeShown.
+	maybeShown bool
 }
 
-// findAttachmentParts recursively finds all attachment parts in a body structure.
+// findAttachmentParts recursively finds all attachment parts in a body
+// structure: parts with a filename, and images without one.
 func findAttachmentParts(bs imap.BodyStructure, path []int) []attachmentPart {
 	var parts []attachmentPart
 
@@ -192,18 +483,23 @@ func findAttachmentParts(bs imap.BodyStructure, path []int) []attachmentPart {
 		// Check if it's an attachment with a filename
 		filename := ""
 		if disp := s.Disposition(); disp != nil && disp.Params != nil {
-			filename = disp.Params["filename"]
+			filename = decodeParam(disp.Params, "filename")
 		}
 		if filename == "" && s.Params != nil {
-			filename = s.Params["name"]
+			filename = decodeParam(s.Params, "name")
 		}
+		filename = normalizeText(filename)
 
-		if filename != "" {
+		if filename != "" || strings.EqualFold(s.Type, "image") {
 			mimeType := strings.ToLower(s.Type) + "/" + strings.ToLower(s.Subtype)
 			parts = append(parts, attachmentPart{
-				path:     append([]int{}, path...),
-				mimeType: mimeType,
-				filename: filename,
+				path:        append([]int{}, path...),
+				mimeType:    mimeType,
+				filename:    filename,
+				encoding:    s.Encoding,
+				size:        int64(s.Size),
+				contentID:   strings.TrimSuffix(strings.TrimPrefix(s.ID, "<"), ">"),
+				description: s.Description,
 			})
 		}
 
@@ -217,14 +513,47 @@ func findAttachmentParts(bs imap.BodyStructure, path []int) []attachmentPart {
 	return parts
 }
 
-// fetchPart fetches a specific MIME part from a message.
-func (m *MailClient) fetchPart(uid imap.UID, part attachmentPart) (*Attachment, error) {
-	// Build section path
-	var section imap.FetchItemBodySection
-	section.Part = part.path
+// StreamAttachment fetches the data of an attachment and passes it to fn as
+// it is read from the server, decoded according to the part's transfer
+// encoding. The reader is only valid until fn returns.
+func (m *MailClient) StreamAttachment(uid imap.UID, att Attachment, fn func(io.Reader) error) error {
+	return m.streamSection(uid, &imap.FetchItemBodySection{Part: att.Part}, att.Encoding, fn)
+}
+
+// PeekAttachment returns the first n bytes of an attachment, decoded
+// according to the part's transfer encoding, or all of it if it is shorter.
+// Only the start of the part is fetched. It returns nil if the part is too
+// long and its start can't be decoded from the bytes fetched.
+func (m *MailClient) PeekAttachment(uid imap.UID, att Attachment, n int) ([]byte, error) {
+	// Enough for n bytes in any transfer encoding, with room for line
+	// breaks and a uuencode header
+	size := int64(4*n + 1024)
+	section := &imap.FetchItemBodySection{
+		Part:    att.Part,
+		Peek:    true,
+		Partial: &imap.SectionPartial{Offset: 0, Size: size},
+	}
+
+	var header []byte
+	err := m.streamSection(uid, section, att.Encoding, func(r io.Reader) error {
+		buf := make([]byte, n)
+		k, err := io.ReadFull(r, buf)
+		switch {
+		case err == nil:
+			header = buf
+		case (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) && att.Size > 0 && att.Size <= size:
+			header = buf[:k]
+		}
+		return nil
+	})
+	return header, err
+}
 
+// streamSection fetches a body section of a message and passes it to fn,
+// decoded according to encoding.
+func (m *MailClient) streamSection(uid imap.UID, section *imap.FetchItemBodySection, encoding string, fn func(io.Reader) error) error {
 	fetchOptions := &imap.FetchOptions{
-		BodySection: []*imap.FetchItemBodySection{&section},
+		BodySection: []*imap.FetchItemBodySection{section},
 	}
 
 	uidSet := imap.UIDSetNum(uid)
@@ -233,37 +562,42 @@ func (m *MailClient) fetchPart(uid imap.UID, part attachmentPart) (*Attachment,
 
 	msg := fetchCmd.Next()
 	if msg == nil {
-		return nil, fmt.Errorf("message not found")
+		return fmt.Errorf("message not found")
 	}
 
-	var data []byte
 	for {
 		item := msg.Next()
 		if item == nil {
 			break
 		}
-		if bodySection, ok := item.(imapclient.FetchItemDataBodySection); ok {
-			var err error
-			data, err = io.ReadAll(bodySection.Literal)
-			if err != nil {
-				return nil, fmt.Errorf("reading body section: %w", err)
-			}
+		bodySection, ok := item.(imapclient.FetchItemDataBodySection)
+		if !ok {
+			continue
+		}
+		if bodySection.Literal == nil {
+			break
 		}
-	}
 
-	if data == nil {
-		return nil, nil
+		r, err := decodeTransferEncoding(bodySection.Literal, encoding)
+		if err != nil {
+			return err
+		}
+		return fn(r)
 	}
 
-	return &Attachment{
-		Filename: part.filename,
-		MIMEType: part.mimeType,
-		Data:     bytes.NewReader(data),
-	}, nil
+	return fmt.Errorf("body section %v not returned by server", section.Part)
 }
 
-// MarkProcessed marks a message as processed by adding our custom keyword.
+// MarkProcessed marks a message as processed by adding our custom keyword,
+// or by recording it in the state file if keywords can't be stored.
 func (m *MailClient) MarkProcessed(uid imap.UID) error {
+	if m.useState {
+		if err := m.state.MarkProcessed(m.stateKey, m.uidValidity, uid); err != nil {
+			return fmt.Errorf("marking message as processed: %w", err)
+		}
+		return nil
+	}
+
 	uidSet := imap.UIDSetNum(uid)
 
 	storeFlags := &imap.StoreFlags{
@@ -311,6 +645,68 @@ func (m *MailClient) MoveMessage(uid imap.UID, destMailbox string) error {
 	return nil
 }
 
+// WaitForNewMail blocks until the selected mailbox may have new messages or
+// ctx is cancelled. If the server supports IDLE it waits for the server to
+// announce new messages; otherwise it sleeps for pollInterval. IDLE only
+// reports changes to the selected mailbox, so callers checking several
+// mailboxes should poll instead.
+func (m *MailClient) WaitForNewMail(ctx context.Context, pollInterval time.Duration) error {
+	if !m.client.Caps().Has(imap.CapIdle) {
+		sleepContext(ctx, pollInterval)
+		return nil
+	}
+
+	for {
+		refresh, err := m.idle(ctx)
+		if err != nil {
+			return err
+		}
+		if !refresh {
+			return nil
+		}
+		m.verbose("Re-issuing IDLE")
+	}
+}
+
+// idle runs a single IDLE command until the mailbox changes, ctx is
+// cancelled, or idleTimeout elapses. It reports whether IDLE timed out and
+// should be re-issued.
+func (m *MailClient) idle(ctx context.Context) (bool, error) {
+	idleCmd, err := m.client.Idle()
+	if err != nil {
+		return false, fmt.Errorf("starting IDLE: %w", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- idleCmd.Wait() }()
+
+	timer := time.NewTimer(idleTimeout)
+	defer timer.Stop()
+
+	refresh := false
+	select {
+	case <-m.updates:
+		m.verbose("Server reported new mail")
+	case <-ctx.Done():
+	case <-timer.C:
+		refresh = true
+	case err := <-done:
+		if err == nil {
+			err = errors.New("connection closed")
+		}
+		return false, fmt.Errorf("IDLE ended unexpectedly: %w", err)
+	}
+
+	if err := idleCmd.Close(); err != nil {
+		return false, fmt.Errorf("stopping IDLE: %w", err)
+	}
+	if err := <-done; err != nil {
+		return false, fmt.Errorf("stopping IDLE: %w", err)
+	}
+
+	return refresh, nil
+}
+
 // Close closes the IMAP connection.
 func (m *MailClient) Close() error {
 	_ = m.client.Logout().Wait()
@@ -1,16 +1,157 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
 )
 
+// newTestServer starts an in-memory IMAP server with a single user owning an
+// INBOX. It returns the server address and the user for seeding messages.
+func newTestServer(t *testing.T, caps imap.CapSet) (string, *imapmemserver.User) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	return ln.Addr().String(), serveTestIMAP(t, ln, caps)
+}
+
+// newTestConfig returns a config with defaults applied for the test server
+// at addr, which saves into a temporary directory and marks processed
+// messages with the mailgrab-seen keyword. Tests set the fields they
+// exercise on top.
+func newTestConfig(t *testing.T, addr string) *Config {
+	t.Helper()
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("splitting address: %v", err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	cfg := &Config{
+		Server:    host,
+		Port:      port,
+		Username:  "user",
+		Password:  "pass",
+		Security:  SecurityNone,
+		Mailbox:   "INBOX",
+		Output:    t.TempDir(),
+		State:     StateKeyword,
+		StateFile: filepath.Join(t.TempDir(), "state.json"),
+	}
+	cfg.applyDefaults()
+	return cfg
+}
+
+// serveTestIMAP serves an in-memory IMAP server on ln until the test ends.
+func serveTestIMAP(t *testing.T, ln net.Listener, caps imap.CapSet) *imapmemserver.User {
+	t.Helper()
+
+	user := imapmemserver.NewUser("user", "pass")
+	if err := user.Create("INBOX", nil); err != nil {
+		t.Fatalf("creating INBOX: %v", err)
+	}
+	mem := imapmemserver.New()
+	mem.AddUser(user)
+
+	srv := imapserver.New(&imapserver.Options{
+		NewSession: func(*imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return mem.NewSession(), nil, nil
+		},
+		Caps:         caps,
+		InsecureAuth: true,
+		Logger:       log.New(io.Discard, "", 0),
+	})
+
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return user
+}
+
+// newTestMailClient returns a MailClient logged in to the test server at addr
+// over a plaintext connection.
+func newTestMailClient(t *testing.T, addr string) *MailClient {
+	t.Helper()
+
+	m := &MailClient{
+		cfg:     &Config{Mailbox: "INBOX"},
+		verbose: func(string, ...any) {},
+		updates: make(chan struct{}, 1),
+	}
+	client, err := imapclient.DialInsecure(addr, m.clientOptions())
+	if err != nil {
+		t.Fatalf("connecting to test server: %v", err)
+	}
+	if err := client.Login("user", "pass").Wait(); err != nil {
+		t.Fatalf("logging in to test server: %v", err)
+	}
+	m.client = client
+	t.Cleanup(func() { _ = m.Close() })
+
+	return m
+}
+
+// appendTestMessage adds a raw RFC 5322 message to a mailbox on the test server.
+func appendTestMessage(t *testing.T, user *imapmemserver.User, mailbox, raw string) {
+	t.Helper()
+
+	if _, err := user.Append(mailbox, bytes.NewReader([]byte(raw)), &imap.AppendOptions{}); err != nil {
+		t.Fatalf("appending test message: %v", err)
+	}
+}
+
+const testMessage = "From: sender@example.com\r\n" +
+	"Subject: Test\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+// testImageMessage returns a raw message with a text part and a base64
+// encoded JPEG attachment.
+func testImageMessage(filename string, image []byte) string {
+	return "From: sender@example.com\r\n" +
+		"Subject: Photo\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=XYZ\r\n" +
+		"\r\n" +
+		"--XYZ\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached\r\n" +
+		"--XYZ\r\n" +
+		"Content-Type: image/jpeg; name=" + filename + "\r\n" +
+		"Content-Disposition: attachment; filename=" + filename + "\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(image) + "\r\n" +
+		"--XYZ--\r\n"
+}
+
 func TestFindAttachmentParts_SinglePart(t *testing.T) {
 	bs := &imap.BodyStructureSinglePart{
-		Type:    "IMAGE",
-		Subtype: "JPEG",
-		Params:  map[string]string{"name": "photo.jpg"},
+		Type:     "IMAGE",
+		Subtype:  "JPEG",
+		Params:   map[string]string{"name": "photo.jpg"},
+		Encoding: "base64",
 	}
 
 	parts := findAttachmentParts(bs, nil)
@@ -25,6 +166,9 @@ func TestFindAttachmentParts_SinglePart(t *testing.T) {
 	if parts[0].mimeType != "image/jpeg" {
 		t.Errorf("expected mimeType 'image/jpeg', got %q", parts[0].mimeType)
 	}
+	if parts[0].encoding != "base64" {
+		t.Errorf("expected encoding 'base64', got %q", parts[0].encoding)
+	}
 }
 
 func TestFindAttachmentParts_MultiPart(t *testing.T) {
@@ -160,3 +304,346 @@ func TestFindAttachmentParts_NoAttachments(t *testing.T) {
 		t.Errorf("expected 0 parts, got %d", len(parts))
 	}
 }
+
+func TestNewMailClient_Security(t *testing.T) {
+	addr, _ := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("splitting address: %v", err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	cfg := &Config{Server: host, Port: port, Username: "user", Password: "pass", Security: SecurityNone}
+	m, err := NewMailClient(cfg, func(string, ...any) {})
+	if err != nil {
+		t.Fatalf("NewMailClient with security none failed: %v", err)
+	}
+	_ = m.Close()
+
+	// The test server doesn't offer STARTTLS, so the upgrade must fail rather
+	// than falling back to plaintext
+	cfg.Security = SecurityStartTLS
+	if m, err := NewMailClient(cfg, func(string, ...any) {}); err == nil {
+		_ = m.Close()
+		t.Error("expected STARTTLS against a server without it to fail, got nil")
+	}
+}
+
+func TestIsLoopbackHost(t *testing.T) {
+	tests := map[string]bool{
+		"localhost":        true,
+		"LOCALHOST":        true,
+		"127.0.0.1":        true,
+		"127.1.2.3":        true,
+		"::1":              true,
+		"imap.example.com": false,
+		"192.168.1.10":     false,
+	}
+	for host, want := range tests {
+		if got := isLoopbackHost(host); got != want {
+			t.Errorf("isLoopbackHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestWaitForNewMail_Idle(t *testing.T) {
+	addr, user := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}, imap.CapIdle: {}})
+	m := newTestMailClient(t, addr)
+
+	if _, err := m.client.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatalf("selecting INBOX: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- m.WaitForNewMail(context.Background(), time.Hour) }()
+
+	// Give IDLE a moment to start before delivering mail
+	time.Sleep(100 * time.Millisecond)
+	appendTestMessage(t, user, "INBOX", testMessage)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitForNewMail failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForNewMail did not return after new mail arrived")
+	}
+
+	// The connection must be usable again once IDLE has stopped
+	if _, err := m.client.Select("INBOX", nil).Wait(); err != nil {
+		t.Errorf("selecting INBOX after IDLE: %v", err)
+	}
+}
+
+func TestWaitForNewMail_IdleCancelled(t *testing.T) {
+	addr, _ := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}, imap.CapIdle: {}})
+	m := newTestMailClient(t, addr)
+
+	if _, err := m.client.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatalf("selecting INBOX: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := m.WaitForNewMail(ctx, time.Hour); err != nil {
+		t.Errorf("WaitForNewMail failed: %v", err)
+	}
+}
+
+// noIdleClient hides the IDLE capability, which the test server always
+// advertises, to exercise the polling fallback.
+type noIdleClient struct {
+	*imapclient.Client
+}
+
+func (c noIdleClient) Caps() imap.CapSet {
+	caps := imap.CapSet{}
+	for capability := range c.Client.Caps() {
+		if capability != imap.CapIdle {
+			caps[capability] = struct{}{}
+		}
+	}
+	return caps
+}
+
+func TestWaitForNewMail_PollFallback(t *testing.T) {
+	addr, _ := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+	m := newTestMailClient(t, addr)
+	m.client = noIdleClient{m.client.(*imapclient.Client)}
+
+	start := time.Now()
+	if err := m.WaitForNewMail(context.Background(), 50*time.Millisecond); err != nil {
+		t.Fatalf("WaitForNewMail failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected to poll for at least 50ms without IDLE, returned after %s", elapsed)
+	}
+}
+
+// collectNewMessages returns every message ForEachNewMessage yields.
+func collectNewMessages(t *testing.T, m *MailClient) []Message {
+	t.Helper()
+
+	var messages []Message
+	err := m.ForEachNewMessage(context.Background(), "INBOX", func(msg Message) error {
+		messages = append(messages, msg)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEachNewMessage failed: %v", err)
+	}
+	return messages
+}
+
+func TestForEachNewMessage(t *testing.T) {
+	addr, user := newTestServer(t, nil)
+	m := newTestMailClient(t, addr)
+
+	for i := 0; i < 3; i++ {
+		appendTestMessage(t, user, "INBOX", testMessage)
+	}
+
+	// Process the first message, then fail as if the connection dropped
+	errDropped := errors.New("connection dropped")
+	var seen []imap.UID
+	err := m.ForEachNewMessage(context.Background(), "INBOX", func(msg Message) error {
+		seen = append(seen, msg.UID)
+		if len(seen) == 2 {
+			return errDropped
+		}
+		if msg.Subject != "Test" || msg.From != "sender@example.com" {
+			t.Errorf("unexpected envelope: subject %q, from %q", msg.Subject, msg.From)
+		}
+		return m.MarkProcessed(msg.UID)
+	})
+	if !errors.Is(err, errDropped) {
+		t.Fatalf("expected callback error to stop iteration, got %v", err)
+	}
+	if len(seen) != 2 {
+		t.Fatalf("expected iteration to stop after 2 messages, got %d", len(seen))
+	}
+
+	// The first message stays processed; the rest are picked up next time
+	remaining := collectNewMessages(t, m)
+	if len(remaining) != 2 {
+		t.Fatalf("expected 2 remaining messages, got %d", len(remaining))
+	}
+	if remaining[0].UID != seen[1] {
+		t.Errorf("expected UID %d to be retried first, got %d", seen[1], remaining[0].UID)
+	}
+}
+
+func TestForEachNewMessage_Cancelled(t *testing.T) {
+	addr, user := newTestServer(t, nil)
+	m := newTestMailClient(t, addr)
+
+	for i := 0; i < 3; i++ {
+		appendTestMessage(t, user, "INBOX", testMessage)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	count := 0
+	err := m.ForEachNewMessage(ctx, "INBOX", func(msg Message) error {
+		count++
+		cancel()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEachNewMessage failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected to stop after the in-flight message, processed %d", count)
+	}
+}
+
+func TestResolveMailboxes(t *testing.T) {
+	addr, user := newTestServer(t, nil)
+	for _, name := range []string{"Photos", "Photos/Trips", "Photos/Archive", "Scans"} {
+		if err := user.Create(name, nil); err != nil {
+			t.Fatalf("creating %s: %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		mailboxes []string
+		want      []string
+	}{
+		{"literal names", []string{"INBOX", "Missing"}, []string{"INBOX", "Missing"}},
+		{"star pattern", []string{"Photos/*"}, []string{"Photos/Archive", "Photos/Trips"}},
+		{"percent pattern", []string{"%"}, []string{"INBOX", "Photos", "Scans"}},
+		{"duplicates removed", []string{"INBOX", "%", "Photos"}, []string{"INBOX", "Photos", "Scans"}},
+		{"no matches", []string{"Nothing/*"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMailClient(t, addr)
+			m.cfg.Mailboxes = tt.mailboxes
+
+			got, err := m.ResolveMailboxes()
+			if err != nil {
+				t.Fatalf("ResolveMailboxes failed: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestResolveMailboxes_SkipsMoveTarget(t *testing.T) {
+	addr, user := newTestServer(t, nil)
+	for _, name := range []string{"Photos", "Photos/Trips", "Photos/Archive"} {
+		if err := user.Create(name, nil); err != nil {
+			t.Fatalf("creating %s: %v", name, err)
+		}
+	}
+
+	m := newTestMailClient(t, addr)
+	m.cfg.Mailboxes = []string{"Photos/*"}
+	m.cfg.PostAction = PostActionMove
+	m.cfg.MoveTo = "Photos/Archive"
+
+	got, err := m.ResolveMailboxes()
+	if err != nil {
+		t.Fatalf("ResolveMailboxes failed: %v", err)
+	}
+	if want := []string{"Photos/Trips"}; !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestForEachNewMessage_StateFile(t *testing.T) {
+	addr, user := newTestServer(t, nil)
+	m := newTestMailClient(t, addr)
+	m.cfg.State = StateFile
+	m.cfg.StateFile = filepath.Join(t.TempDir(), "state.json")
+
+	appendTestMessage(t, user, "INBOX", testMessage)
+	appendTestMessage(t, user, "INBOX", testMessage)
+
+	messages := collectNewMessages(t, m)
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if err := m.MarkProcessed(messages[0].UID); err != nil {
+		t.Fatalf("MarkProcessed failed: %v", err)
+	}
+
+	// The keyword must not have been stored on the server
+	searchData, err := m.client.UIDSearch(&imap.SearchCriteria{Flag: []imap.Flag{seenKeyword}}, nil).Wait()
+	if err != nil {
+		t.Fatalf("searching for keyword: %v", err)
+	}
+	if uids := searchData.AllUIDs(); len(uids) != 0 {
+		t.Errorf("expected no messages with %s keyword, got %v", seenKeyword, uids)
+	}
+
+	remaining := collectNewMessages(t, m)
+	if len(remaining) != 1 || remaining[0].UID != messages[1].UID {
+		t.Errorf("expected only UID %d to remain, got %v", messages[1].UID, remaining)
+	}
+
+	if _, err := os.Stat(m.cfg.StateFile); err != nil {
+		t.Errorf("expected state file to be written: %v", err)
+	}
+}
+
+func TestStreamAttachment(t *testing.T) {
+	addr, user := newTestServer(t, nil)
+	m := newTestMailClient(t, addr)
+
+	image := []byte("\xff\xd8\xff\xe0fake jpeg data")
+	appendTestMessage(t, user, "INBOX", testImageMessage("photo.jpg", image))
+
+	messages := collectNewMessages(t, m)
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	msg := messages[0]
+	if len(msg.Attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(msg.Attachments))
+	}
+	att := msg.Attachments[0]
+	if att.Data != nil {
+		t.Error("expected attachment data not to be fetched up front")
+	}
+
+	var got []byte
+	err := m.StreamAttachment(msg.UID, att, func(r io.Reader) error {
+		var err error
+		got, err = io.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("StreamAttachment failed: %v", err)
+	}
+	if !bytes.Equal(got, image) {
+		t.Errorf("expected decoded image %q, got %q", image, got)
+	}
+}
+
+func TestForEachNewMessage_EncodedNames(t *testing.T) {
+	addr, user := newTestServer(t, nil)
+	m := newTestMailClient(t, addr)
+
+	raw := strings.Replace(testImageMessage(`"=?KOI8-R?B?xs/Uzy5qcGc=?="`, []byte("\xff\xd8\xff\xe0")),
+		"Subject: Photo", "Subject: =?ISO-2022-JP?B?GyRCPEw/PxsoQg==?=", 1)
+	appendTestMessage(t, user, "INBOX", raw)
+
+	messages := collectNewMessages(t, m)
+	if len(messages) != 1 || len(messages[0].Attachments) != 1 {
+		t.Fatalf("expected 1 message with 1 attachment, got %+v", messages)
+	}
+	if got := messages[0].Subject; got != "写真" {
+		t.Errorf("expected the subject to be decoded, got %q", got)
+	}
+	if got := messages[0].Attachments[0].Filename; got != "фото.jpg" {
+		t.Errorf("expected the filename to be decoded, got %q", got)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+type InlineImages string
+
+const (
+	InlineInclude InlineImages = "include"
+	InlineExclude InlineImages = "exclude"
+	InlineAuto    InlineImages = "auto"
+)
+
+// maxHTMLBody bounds how much of an HTML body is read to find the images it
+// shows.
+const maxHTMLBody = 1 << 20
+
+// maxInlineName bounds the length of filenames made up for inline images.
+const maxInlineName = 100
+
+// cidPattern matches cid: URLs, as used by an HTML body to show images that
+// are parts of the same message.
+var cidPattern = regexp.MustCompile(`(?i)cid:([^"'\s)>]+)`)
+
+// selectInlineParts applies the inline_images setting to the attachment parts
+// of a message. With exclude, images without a filename are dropped. With
+// auto, images without a filename that are shown in the HTML body of the
+// message are dropped, as they are usually logos and other decoration.
+// Images with a filename are kept, since some mail clients, like Apple Mail,
+// show attached photos in the body too. Dry runs don't fetch the HTML body,
+// and mark the images it might show instead.
+func (m *MailClient) selectInlineParts(uid imap.UID, bs imap.BodyStructure, parts []attachmentPart) ([]attachmentPart, error) {
+	switch m.cfg.InlineImages {
+	case InlineInclude:
+		return parts, nil
+	case InlineExclude:
+		return slices.DeleteFunc(parts, func(p attachmentPart) bool { return p.filename == "" }), nil
+	}
+
+	// Only images with a Content-ID can be shown by the HTML body, which
+	// needn't be fetched if there are none without a filename
+	hasCID := func(p attachmentPart) bool {
+		return p.filename == "" && p.contentID != "" && IsImageMIME(p.mimeType)
+	}
+	if !slices.ContainsFunc(parts, hasCID) {
+		return parts, nil
+	}
+	if m.cfg.DryRun {
+		for i := range parts {
+			parts[i].maybeShown = hasCID(parts[i])
+		}
+		return parts, nil
+	}
+
+	shown := make(map[string]bool)
+	for _, html := range findHTMLParts(bs, nil) {
+		section := &imap.FetchItemBodySection{Part: html.path, Peek: true}
+		err := m.streamSection(uid, section, html.encoding, func(r io.Reader) error {
+			body, err := io.ReadAll(io.LimitReader(r, maxHTMLBody))
+			if err != nil {
+				return err
+			}
+			for _, cid := range findCIDs(string(body)) {
+				shown[cid] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("fetching HTML body: %w", err)
+		}
+	}
+
+	return slices.DeleteFunc(parts, func(p attachmentPart) bool {
+		if hasCID(p) && shown[p.contentID] {
+			m.verbose("  Skipped: inline image %s (shown in the HTML body)", p.contentID)
+			return true
+		}
+		return false
+	}), nil
+}
+
+// findHTMLParts recursively finds the text/html parts in a body structure.
+func findHTMLParts(bs imap.BodyStructure, path []int) []attachmentPart {
+	var parts []attachmentPart
+	switch s := bs.(type) {
+	case *imap.BodyStructureSinglePart:
+		if strings.EqualFold(s.Type, "text") && strings.EqualFold(s.Subtype, "html") {
+			parts = append(parts, attachmentPart{path: append([]int{}, path...), encoding: s.Encoding})
+		}
+	case *imap.BodyStructureMultiPart:
+		for i, child := range s.Children {
+			parts = append(parts, findHTMLParts(child, append(path, i+1))...)
+		}
+	}
+	return parts
+}
+
+// findCIDs returns the Content-IDs referenced by cid: URLs in an HTML body.
+func findCIDs(html string) []string {
+	var cids []string
+	for _, match := range cidPattern.FindAllStringSubmatch(html, -1) {
+		cid, err := url.PathUnescape(match[1])
+		if err != nil {
+			cid = match[1]
+		}
+		cids = append(cids, cid)
+	}
+	return cids
+}
+
+// inlineFilename makes up a filename for an image without one, from its
+// Content-Description or Content-ID, or else from the UID of its message and
+// its part number, like image-42-1.2.jpg.
+func inlineFilename(uid imap.UID, p attachmentPart) string {
+	ext := mimeExtension(p.mimeType)
+
+	cidName, _, _ := strings.Cut(p.contentID, "@")
+	for _, name := range []string{p.description, cidName} {
+		name = sanitizeInlineName(name)
+		if name == "" {
+			continue
+		}
+		if hasImageExtension(name) || strings.EqualFold(filepath.Ext(name), ext) {
+			return name
+		}
+		return name + ext
+	}
+
+	part := make([]string, len(p.path))
+	for i, n := range p.path {
+		part[i] = fmt.Sprint(n)
+	}
+	if len(part) == 0 {
+		part = []string{"1"}
+	}
+	return fmt.Sprintf("image-%d-%s%s", uid, strings.Join(part, "."), ext)
+}
+
+// sanitizeInlineName turns a Content-Description or Content-ID into
+// something safe to use as a filename.
+func sanitizeInlineName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" ._-()", r):
+			return r
+		}
+		return '_'
+	}, name)
+	if len(name) > maxInlineName {
+		name = name[:maxInlineName]
+	}
+	return strings.Trim(name, " ._")
+}
+
+// mimeExtension returns the usual file extension for an image MIME type.
+func mimeExtension(mimeType string) string {
+	for _, t := range imageTypes {
+		if t.MIMEType == mimeType {
+			return t.Exts[0]
+		}
+	}
+	_, subtype, _ := strings.Cut(mimeType, "/")
+	subtype = strings.TrimPrefix(subtype, "x-")
+	subtype, _, _ = strings.Cut(subtype, "+")
+	if subtype == "" {
+		return ""
+	}
+	return "." + subtype
+}
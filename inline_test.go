@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestFindAttachmentParts_InlineImage(t *testing.T) {
+	bs := &imap.BodyStructureMultiPart{
+		Children: []imap.BodyStructure{
+			&imap.BodyStructureSinglePart{Type: "TEXT", Subtype: "HTML"},
+			&imap.BodyStructureSinglePart{Type: "IMAGE", Subtype: "PNG", ID: "<logo@example.com>", Description: "Logo"},
+			&imap.BodyStructureSinglePart{Type: "APPLICATION", Subtype: "PDF"},
+		},
+	}
+
+	parts := findAttachmentParts(bs, nil)
+	if len(parts) != 1 {
+		t.Fatalf("expected only the image without a filename, got %+v", parts)
+	}
+	if parts[0].filename != "" || parts[0].contentID != "logo@example.com" || parts[0].description != "Logo" {
+		t.Errorf("unexpected part %+v", parts[0])
+	}
+
+	html := findHTMLParts(bs, nil)
+	if len(html) != 1 || !slices.Equal(html[0].path, []int{1}) {
+		t.Errorf("expected the HTML part at [1], got %+v", html)
+	}
+}
+
+func TestFindCIDs(t *testing.T) {
+	html := `<img src="cid:logo@example.com"><img src='CID:photo%201@example.com'>` +
+		`<div style="background: url(cid:bg@example.com)">`
+	want := []string{"logo@example.com", "photo 1@example.com", "bg@example.com"}
+	if got := findCIDs(html); !slices.Equal(got, want) {
+		t.Errorf("findCIDs() = %v, want %v", got, want)
+	}
+}
+
+func TestInlineFilename(t *testing.T) {
+	tests := []struct {
+		part attachmentPart
+		want string
+	}{
+		{attachmentPart{mimeType: "image/jpeg", description: "Beach.jpg"}, "Beach.jpg"},
+		{attachmentPart{mimeType: "image/jpeg", description: "Our trip"}, "Our trip.jpg"},
+		{attachmentPart{mimeType: "image/png", description: "../../etc/passwd"}, "etc_passwd.png"},
+		{attachmentPart{mimeType: "image/png", contentID: "image001.png@01D9A1B2.C3D4E5F0"}, "image001.png"},
+		{attachmentPart{mimeType: "image/gif", contentID: "ii_lq2x3@mail.gmail.com"}, "ii_lq2x3.gif"},
+		{attachmentPart{mimeType: "image/jpeg", path: []int{2, 1}}, "image-42-2.1.jpg"},
+		{attachmentPart{mimeType: "image/svg+xml", contentID: "@"}, "image-42-1.svg"},
+	}
+	for _, tt := range tests {
+		if got := inlineFilename(42, tt.part); got != tt.want {
+			t.Errorf("inlineFilename(%+v) = %q, want %q", tt.part, got, tt.want)
+		}
+	}
+}
+
+// testInlineMessage returns an HTML message that shows a logo and also
+// carries a photo, neither with a filename, and shows a named photo the way
+// Apple Mail sends them.
+func testInlineMessage(logo, photo []byte) string {
+	return "From: sender@example.com\r\n" +
+		"Subject: Newsletter\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/related; boundary=XYZ\r\n" +
+		"\r\n" +
+		"--XYZ\r\n" +
+		"Content-Type: text/html\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"<p>Hello</p><img src=3D\"cid:logo@example.com\"><img src=3D\"cid:IMG_0001@example.com\">\r\n" +
+		"--XYZ\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-ID: <logo@example.com>\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(logo) + "\r\n" +
+		"--XYZ\r\n" +
+		"Content-Type: image/jpeg\r\n" +
+		"Content-ID: <photo1@example.com>\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(photo) + "\r\n" +
+		"--XYZ\r\n" +
+		"Content-Type: image/jpeg; name=IMG_0001.jpg\r\n" +
+		"Content-Disposition: inline; filename=IMG_0001.jpg\r\n" +
+		"Content-ID: <IMG_0001@example.com>\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(photo) + "\r\n" +
+		"--XYZ--\r\n"
+}
+
+func TestProcessNewMessages_InlineImages(t *testing.T) {
+	tests := []struct {
+		mode InlineImages
+		want []string
+	}{
+		{InlineAuto, []string{"IMG_0001.jpg", "photo1.jpg"}},
+		{InlineInclude, []string{"IMG_0001.jpg", "logo.png", "photo1.jpg"}},
+		{InlineExclude, []string{"IMG_0001.jpg"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			addr, user := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+			appendTestMessage(t, user, "INBOX", testInlineMessage([]byte("\x89PNG\r\n\x1a\nlogo"), []byte("\xff\xd8\xff\xe0photo")))
+
+			cfg := newTestConfig(t, addr)
+			cfg.InlineImages = tt.mode
+
+			stats, code := runOnce(context.Background(), cfg, func(string, ...any) {})
+			if code != exitOK {
+				t.Fatalf("runOnce returned %d, want %d", code, exitOK)
+			}
+			if stats.Saved != len(tt.want) {
+				t.Errorf("expected %d file(s), got %+v", len(tt.want), stats)
+			}
+
+			entries, err := os.ReadDir(cfg.Output)
+			if err != nil {
+				t.Fatalf("reading output directory: %v", err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected %v to be saved, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSelectInlineParts_DryRun(t *testing.T) {
+	bs := &imap.BodyStructureMultiPart{
+		Children: []imap.BodyStructure{
+			&imap.BodyStructureSinglePart{Type: "TEXT", Subtype: "HTML"},
+			&imap.BodyStructureSinglePart{Type: "IMAGE", Subtype: "PNG", ID: "<logo@example.com>"},
+			&imap.BodyStructureSinglePart{Type: "IMAGE", Subtype: "PNG"},
+		},
+	}
+
+	// Without a client, fetching the HTML body would panic
+	m := &MailClient{cfg: &Config{InlineImages: InlineAuto, DryRun: true}}
+	parts, err := m.selectInlineParts(1, bs, findAttachmentParts(bs, nil))
+	if err != nil {
+		t.Fatalf("selectInlineParts() failed: %v", err)
+	}
+	if len(parts) != 2 || !parts[0].maybeShown || parts[1].maybeShown {
+		t.Errorf("expected only the image with a Content-ID to be marked, got %+v", parts)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+
+	// Decoders for reading image dimensions
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// maxImageHeader bounds how much of an image is read to find its dimensions.
+// JPEG files can carry large EXIF thumbnails before the frame header.
+const maxImageHeader = 1 << 20
+
+// ErrSizeLimit is returned when an attachment is smaller or larger than
+// allowed by min_bytes, max_bytes, min_width, or min_height.
+var ErrSizeLimit = errors.New("outside the size limits")
+
+// SizeFilter skips attachments by their size and, for images, their
+// dimensions. Zero values mean no limit.
+type SizeFilter struct {
+	MinBytes  ByteSize
+	MaxBytes  ByteSize
+	MinWidth  int
+	MinHeight int
+}
+
+// sizeFilter returns the SizeFilter for the min_bytes, max_bytes, min_width,
+// and min_height settings.
+func (c *Config) sizeFilter() SizeFilter {
+	return SizeFilter{
+		MinBytes:  c.MinBytes,
+		MaxBytes:  c.MaxBytes,
+		MinWidth:  c.MinWidth,
+		MinHeight: c.MinHeight,
+	}
+}
+
+// validateSizeLimits checks the min_bytes, max_bytes, min_width, and
+// min_height settings.
+func (c *Config) validateSizeLimits() error {
+	if c.MinBytes > 0 && c.MaxBytes > 0 && c.MaxBytes < c.MinBytes {
+		return errors.New("max_bytes must not be less than min_bytes")
+	}
+	if c.MinWidth < 0 || c.MinHeight < 0 {
+		return errors.New("min_width and min_height can't be negative")
+	}
+	return nil
+}
+
+// decodedSizeRange returns the least and most bytes a part of size bytes on
+// the server can hold once its transfer encoding is decoded. Base64 lines
+// are assumed to be at least 60 characters long, as every mail client
+// writes them.
+func decodedSizeRange(size int64, encoding string) (least, most int64) {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		most = size / 4 * 3
+		least = max(size*60/62/4*3-2, 0)
+	case "quoted-printable":
+		// An encoded byte takes up to three characters
+		most = size
+		least = size / 3
+	default:
+		least, most = size, size
+	}
+	return least, most
+}
+
+// Precheck returns an ErrSizeLimit error if the size of att on the server
+// shows it is too small or too large, so that it needn't be downloaded.
+func (f SizeFilter) Precheck(att Attachment) error {
+	if att.Size <= 0 {
+		return nil
+	}
+	least, most := decodedSizeRange(att.Size, att.Encoding)
+	if f.MinBytes > 0 && most < int64(f.MinBytes) {
+		return fmt.Errorf("%w: smaller than min_bytes (%s)", ErrSizeLimit, f.MinBytes)
+	}
+	if f.MaxBytes > 0 && least > int64(f.MaxBytes) {
+		return fmt.Errorf("%w: larger than max_bytes (%s)", ErrSizeLimit, f.MaxBytes)
+	}
+	return nil
+}
+
+// Check checks the content of att, whose Data must be set, against the
+// limits. It reads at most min_bytes and, for images when a minimum width or
+// height is set, the image header. The returned attachment reads the same
+// data, and fails with an ErrSizeLimit error once more than max_bytes have
+// been read. Images whose dimensions can't be read are not skipped.
+func (f SizeFilter) Check(att Attachment) (Attachment, error) {
+	if f.MinBytes > 0 {
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, att.Data, int64(f.MinBytes))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return att, err
+		}
+		if n < int64(f.MinBytes) {
+			return att, fmt.Errorf("%w: %d bytes is smaller than min_bytes (%s)", ErrSizeLimit, n, f.MinBytes)
+		}
+		att.Data = io.MultiReader(&buf, att.Data)
+	}
+
+	if (f.MinWidth > 0 || f.MinHeight > 0) && IsImageMIME(att.MIMEType) {
+		var buf bytes.Buffer
+		config, _, err := image.DecodeConfig(io.TeeReader(io.LimitReader(att.Data, maxImageHeader), &buf))
+		att.Data = io.MultiReader(&buf, att.Data)
+		switch {
+		case err != nil:
+		case config.Width < f.MinWidth:
+			return att, fmt.Errorf("%w: %dx%d is narrower than min_width (%d)", ErrSizeLimit, config.Width, config.Height, f.MinWidth)
+		case config.Height < f.MinHeight:
+			return att, fmt.Errorf("%w: %dx%d is shorter than min_height (%d)", ErrSizeLimit, config.Width, config.Height, f.MinHeight)
+		}
+	}
+
+	if f.MaxBytes > 0 {
+		att.Data = &maxBytesReader{r: att.Data, limit: f.MaxBytes, left: int64(f.MaxBytes)}
+	}
+	return att, nil
+}
+
+// maxBytesReader fails once more than limit bytes have been read.
+type maxBytesReader struct {
+	r     io.Reader
+	limit ByteSize
+	left  int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > m.left+1 {
+		p = p[:m.left+1]
+	}
+	n, err := m.r.Read(p)
+	m.left -= int64(n)
+	if m.left < 0 {
+		return 0, fmt.Errorf("%w: larger than max_bytes (%s)", ErrSizeLimit, m.limit)
+	}
+	return n, err
+}
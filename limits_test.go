@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// testPNG returns a PNG image of the given dimensions.
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("encoding PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodedSizeRange(t *testing.T) {
+	tests := []struct {
+		size      int64
+		encoding  string
+		wantLeast int64
+		wantMost  int64
+	}{
+		{1000, "7bit", 1000, 1000},
+		{1000, "", 1000, 1000},
+		{1000, "BASE64", 721, 750},
+		{900, "quoted-printable", 300, 900},
+	}
+	for _, tt := range tests {
+		least, most := decodedSizeRange(tt.size, tt.encoding)
+		if least != tt.wantLeast || most != tt.wantMost {
+			t.Errorf("decodedSizeRange(%d, %q) = %d, %d, want %d, %d", tt.size, tt.encoding, least, most, tt.wantLeast, tt.wantMost)
+		}
+	}
+}
+
+func TestSizeFilterPrecheck(t *testing.T) {
+	filter := SizeFilter{MinBytes: 10 * kilobyte, MaxBytes: megabyte}
+
+	tests := []struct {
+		name string
+		att  Attachment
+		want bool
+	}{
+		{"unknown size", Attachment{}, true},
+		{"in range", Attachment{Size: 100000, Encoding: "base64"}, true},
+		{"logo", Attachment{Size: 2800, Encoding: "base64"}, false},
+		{"too large", Attachment{Size: 2000000, Encoding: "base64"}, false},
+		// Base64 makes a 1MB file larger on the server
+		{"just under max", Attachment{Size: 1300000, Encoding: "base64"}, true},
+	}
+	for _, tt := range tests {
+		err := filter.Precheck(tt.att)
+		if tt.want && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if !tt.want && !errors.Is(err, ErrSizeLimit) {
+			t.Errorf("%s: expected ErrSizeLimit, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestSizeFilterCheck(t *testing.T) {
+	photo := testPNG(t, 640, 480)
+	newAtt := func(data []byte) Attachment {
+		return Attachment{Filename: "photo.png", MIMEType: "image/png", Data: bytes.NewReader(data)}
+	}
+
+	// Data read to check the limits is still there to be saved
+	filter := SizeFilter{MinBytes: ByteSize(len(photo)), MinWidth: 100, MinHeight: 100}
+	att, err := filter.Check(newAtt(photo))
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if data, err := io.ReadAll(att.Data); err != nil || !bytes.Equal(data, photo) {
+		t.Errorf("expected the whole content to be read, got %d bytes, %v", len(data), err)
+	}
+
+	if _, err := (SizeFilter{MinBytes: ByteSize(len(photo) + 1)}).Check(newAtt(photo)); !errors.Is(err, ErrSizeLimit) {
+		t.Errorf("expected ErrSizeLimit below min_bytes, got %v", err)
+	}
+	if _, err := (SizeFilter{MinWidth: 100}).Check(newAtt(testPNG(t, 16, 640))); !errors.Is(err, ErrSizeLimit) {
+		t.Errorf("expected ErrSizeLimit below min_width, got %v", err)
+	}
+	if _, err := (SizeFilter{MinHeight: 100}).Check(newAtt(testPNG(t, 640, 16))); !errors.Is(err, ErrSizeLimit) {
+		t.Errorf("expected ErrSizeLimit below min_height, got %v", err)
+	}
+
+	// Images without a decoder, and files that aren't images, are let through
+	heic := Attachment{Filename: "photo.heic", MIMEType: "image/heic", Data: bytes.NewReader(ftyp("heic"))}
+	if _, err := (SizeFilter{MinWidth: 100}).Check(heic); err != nil {
+		t.Errorf("expected an image without a decoder to pass, got %v", err)
+	}
+	pdf := Attachment{Filename: "scan.pdf", MIMEType: "application/pdf", Data: strings.NewReader("%PDF-1.7")}
+	if _, err := (SizeFilter{MinWidth: 100}).Check(pdf); err != nil {
+		t.Errorf("expected a PDF to pass, got %v", err)
+	}
+
+	// max_bytes is enforced while the data is read
+	att, err = SizeFilter{MaxBytes: ByteSize(len(photo))}.Check(newAtt(photo))
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if _, err := io.ReadAll(att.Data); err != nil {
+		t.Errorf("expected a file of exactly max_bytes to be read, got %v", err)
+	}
+	att, err = SizeFilter{MaxBytes: ByteSize(len(photo) - 1)}.Check(newAtt(photo))
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if _, err := io.ReadAll(att.Data); !errors.Is(err, ErrSizeLimit) {
+		t.Errorf("expected ErrSizeLimit above max_bytes, got %v", err)
+	}
+}
+
+func TestProcessNewMessages_SizeLimits(t *testing.T) {
+	addr, user := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+	for name, data := range map[string][]byte{
+		"logo.png":  testPNG(t, 32, 32),
+		"photo.png": testPNG(t, 640, 480),
+		"huge.png":  append(testPNG(t, 640, 480), make([]byte, 8*int(kilobyte))...),
+	} {
+		appendTestMessage(t, user, "INBOX", strings.Replace(testImageMessage(name, data), "image/jpeg", "image/png", 1))
+	}
+
+	cfg := newTestConfig(t, addr)
+	cfg.MaxBytes = 4 * kilobyte
+	cfg.MinWidth = 100
+	cfg.MinHeight = 100
+
+	stats, code := runOnce(context.Background(), cfg, func(string, ...any) {})
+	if code != exitOK {
+		t.Fatalf("runOnce returned %d, want %d", code, exitOK)
+	}
+	if stats.Messages != 3 || stats.Saved != 1 {
+		t.Errorf("expected 3 messages and 1 file, got %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Output, "photo.png")); err != nil {
+		t.Errorf("expected the photo to be saved: %v", err)
+	}
+	for _, name := range []string{"logo.png", "huge.png"} {
+		if _, err := os.Stat(filepath.Join(cfg.Output, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be saved, got %v", name, err)
+		}
+	}
+}
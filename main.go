@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/emersion/go-imap/v2"
 )
 
 const (
@@ -15,6 +23,8 @@ const (
 
 // JSONMessageOutput represents a message in JSON output
 type JSONMessageOutput struct {
+	Account string   `json:"account,omitempty"`
+	Mailbox string   `json:"mailbox"`
 	From    string   `json:"from"`
 	Subject string   `json:"subject"`
 	Images  []string `json:"images"`
@@ -31,62 +41,224 @@ func run() int {
 		return exitConfigError
 	}
 
-	// Set up logging based on verbosity
-	verbose := func(format string, args ...any) {}
-	if cfg.Verbose {
-		verbose = func(format string, args ...any) {
-			fmt.Printf(format+"\n", args...)
-		}
+	if cfg.Command == "doctor" {
+		return runDoctor(cfg)
+	}
+
+	// Stop after the in-flight message on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if len(cfg.Accounts) > 0 {
+		return runAccounts(ctx, cfg)
+	}
+
+	verbose := newVerbose(cfg)
+	if cfg.Watch {
+		return runWatch(ctx, cfg, verbose)
+	}
+
+	stats, code := runOnce(ctx, cfg, verbose)
+	saveJSONOutput(cfg.JSONOutput, stats.Output)
+	if code != exitOK {
+		return code
+	}
+
+	if !cfg.Quiet {
+		printSummary(cfg.logPrefix(), stats)
+	}
+
+	return exitOK
+}
+
+// newVerbose returns the function used for verbose output, which does nothing
+// unless cfg.Verbose is set.
+func newVerbose(cfg *Config) func(string, ...any) {
+	if !cfg.Verbose {
+		return func(format string, args ...any) {}
+	}
+	prefix := cfg.logPrefix()
+	return func(format string, args ...any) {
+		fmt.Println(prefix + fmt.Sprintf(format, args...))
 	}
+}
 
-	// Connect to IMAP server
+// runOnce connects to the server and makes a single pass over the mailboxes.
+func runOnce(ctx context.Context, cfg *Config, verbose func(string, ...any)) (runStats, int) {
 	client, err := NewMailClient(cfg, verbose)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		return exitConnectError
+		fmt.Fprintf(os.Stderr, "%sError: %v\n", cfg.logPrefix(), err)
+		return runStats{}, exitConnectError
 	}
 	defer func() { _ = client.Close() }()
 
-	// Fetch new messages
-	messages, err := client.FetchNewMessages()
+	return processNewMessages(ctx, cfg, client, verbose)
+}
+
+// runStats summarizes a single pass over the mailboxes.
+type runStats struct {
+	Messages  int
+	Saved     int
+	Mailboxes []mailboxStats
+	// Output describes the messages whose images were saved, for the JSON
+	// output file.
+	Output []JSONMessageOutput
+	// DryRun is set if nothing was actually saved or changed.
+	DryRun bool
+}
+
+// mailboxStats summarizes a single pass over one mailbox.
+type mailboxStats struct {
+	Name     string
+	Messages int
+	Saved    int
+}
+
+// printSummary prints the totals of a pass, broken down by mailbox when more
+// than one was checked.
+func printSummary(prefix string, stats runStats) {
+	if stats.Messages == 0 {
+		fmt.Println(prefix + "No new messages")
+		return
+	}
+	if stats.DryRun {
+		fmt.Printf("%sDry run: would process %d message(s) and save %d file(s)\n", prefix, stats.Messages, stats.Saved)
+	} else {
+		fmt.Printf("%sProcessed %d message(s), saved %d file(s)\n", prefix, stats.Messages, stats.Saved)
+	}
+	if len(stats.Mailboxes) > 1 {
+		for _, mbox := range stats.Mailboxes {
+			fmt.Printf("  %s: %d message(s), %d file(s)\n", mbox.Name, mbox.Messages, mbox.Saved)
+		}
+	}
+}
+
+// processNewMessages saves the images of each new message in every
+// configured mailbox and applies the post-action, one message at a time,
+// reusing the client's connection. With cfg.DryRun it only prints what it
+// would do. It stops early, between messages, once
+// ctx is cancelled. A mailbox that fails doesn't stop the others from being
+// checked, but makes the pass fail. Messages processed before a failure are
+// still included in the returned stats.
+func processNewMessages(ctx context.Context, cfg *Config, client *MailClient, verbose func(string, ...any)) (runStats, int) {
+	stats := runStats{DryRun: cfg.DryRun}
+
+	saveOpts := SaveOptions{OnConflict: cfg.OnConflict}
+	if cfg.OutputTemplate != "" {
+		tmpl, err := ParseOutputTemplate(cfg.OutputTemplate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sError: %v\n", cfg.logPrefix(), err)
+			return stats, exitConfigError
+		}
+		saveOpts.Template = tmpl
+	}
+
+	mailboxes, err := client.ResolveMailboxes()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		return exitProcessError
+		fmt.Fprintf(os.Stderr, "%sError: %v\n", cfg.logPrefix(), err)
+		return stats, exitProcessError
+	}
+
+	var planner *dryRunPlanner
+	if cfg.DryRun {
+		planner = newDryRunPlanner(OSFileWriter{}, cfg.logPrefix())
 	}
 
-	if len(messages) == 0 {
-		if !cfg.Quiet {
-			fmt.Println("No new messages")
+	failed := false
+	for _, mailbox := range mailboxes {
+		if ctx.Err() != nil {
+			break
+		}
+		mboxStats, err := processMailbox(ctx, cfg, client, mailbox, saveOpts, planner, &stats.Output, verbose)
+		stats.Messages += mboxStats.Messages
+		stats.Saved += mboxStats.Saved
+		stats.Mailboxes = append(stats.Mailboxes, mboxStats)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sError: %v\n", cfg.logPrefix(), err)
+			failed = true
 		}
-		return exitOK
 	}
 
-	verbose("Processing %d message(s)...", len(messages))
+	if failed {
+		return stats, exitProcessError
+	}
 
+	return stats, exitOK
+}
+
+// processMailbox handles the new messages in a single mailbox, appending
+// messages with saved images to jsonOutput. If planner is set, messages are
+// only passed to it and left untouched.
+func processMailbox(ctx context.Context, cfg *Config, client *MailClient, mailbox string, saveOpts SaveOptions, planner *dryRunPlanner, jsonOutput *[]JSONMessageOutput, verbose func(string, ...any)) (mailboxStats, error) {
+	stats := mailboxStats{Name: mailbox}
 	fileWriter := OSFileWriter{}
-	totalSaved := 0
-	outputDirCreated := false
-	var jsonOutput []JSONMessageOutput
+	types := cfg.typeFilter()
+	sizes := cfg.sizeFilter()
+
+	err := client.ForEachNewMessage(ctx, mailbox, func(msg Message) error {
+		// Filter to attachments of the types to save
+		candidates := types.Candidates(msg.Attachments)
+
+		if planner != nil {
+			stats.Messages++
+			stats.Saved += planner.planMessage(cfg, msg, candidates, saveOpts)
+			return nil
+		}
 
-	for _, msg := range messages {
-		// Filter to only image attachments
-		images := FilterImageAttachments(msg.Attachments)
+		if !senderAllowed(cfg.AllowSenders, cfg.DenySenders, msg.From) {
+			verbose("  Message %d: %q - sender %s not allowed", msg.UID, msg.Subject, msg.From)
+			stats.Messages++
+			finishMessage(cfg, client, msg.UID, cfg.RejectedAction, cfg.RejectedMoveTo)
+			return nil
+		}
 
 		savedCount := 0
 		var savedFilenames []string
-		for _, att := range images {
-			// Create output directory on first image save
-			if !outputDirCreated {
-				if err := os.MkdirAll(cfg.Output, 0755); err != nil {
-					fmt.Fprintf(os.Stderr, "Error: creating output directory: %v\n", err)
-					return exitConfigError
+		saveOpts.Message = &msg
+		for _, att := range candidates {
+			if err := sizes.Precheck(att); err != nil {
+				verbose("  Skipped: %s (%v)", att.Filename, err)
+				continue
+			}
+			// Look at the start of attachments that may not be images
+			// at all, rather than downloading each whole
+			if types.NeedsPeek(att) {
+				header, err := client.PeekAttachment(msg.UID, att, sniffLen)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%sError: saving attachment %s: %v\n", cfg.logPrefix(), att.Filename, err)
+					continue
+				}
+				if header != nil {
+					if err := types.Precheck(att, header); err != nil {
+						verbose("  Skipped: %s (%v)", att.Filename, err)
+						continue
+					}
 				}
-				outputDirCreated = true
 			}
-
-			path, err := SaveAttachment(fileWriter, cfg.Output, att)
+			var path string
+			err := client.StreamAttachment(msg.UID, att, func(r io.Reader) error {
+				att.Data = r
+				var err error
+				if att, err = types.Check(att); err != nil {
+					return err
+				}
+				if att, err = sizes.Check(att); err != nil {
+					return err
+				}
+				outputDir := filepath.Join(cfg.Output, types.Dir(att))
+				path, err = SaveAttachment(fileWriter, outputDir, att, saveOpts)
+				return err
+			})
+			if errors.Is(err, ErrNotImage) || errors.Is(err, ErrTypeNotIncluded) || errors.Is(err, ErrSizeLimit) {
+				verbose("  Skipped: %s (%v)", att.Filename, err)
+				continue
+			}
+			if errors.Is(err, ErrFileExists) {
+				verbose("  Skipped: %s (already exists)", path)
+				continue
+			}
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: saving attachment %s: %v\n", att.Filename, err)
+				fmt.Fprintf(os.Stderr, "%sError: saving attachment %s: %v\n", cfg.logPrefix(), att.Filename, err)
 				continue
 			}
 			verbose("  Saved: %s", path)
@@ -94,56 +266,63 @@ func run() int {
 			savedFilenames = append(savedFilenames, att.Filename)
 		}
 
-		// Add to JSON output if images were saved
+		// Add to JSON output if files were saved
 		if len(savedFilenames) > 0 {
-			jsonOutput = append(jsonOutput, JSONMessageOutput{
+			*jsonOutput = append(*jsonOutput, JSONMessageOutput{
+				Mailbox: mailbox,
 				From:    msg.From,
 				Subject: msg.Subject,
 				Images:  savedFilenames,
 			})
 		}
 
-		if cfg.Verbose {
-			if savedCount > 0 {
-				fmt.Printf("  Message %d: %q - saved %d image(s)\n", msg.UID, msg.Subject, savedCount)
-			} else {
-				fmt.Printf("  Message %d: %q - no image attachments\n", msg.UID, msg.Subject)
-			}
+		if savedCount > 0 {
+			verbose("  Message %d: %q - saved %d file(s)", msg.UID, msg.Subject, savedCount)
+		} else {
+			verbose("  Message %d: %q - no matching attachments", msg.UID, msg.Subject)
 		}
 
-		totalSaved += savedCount
+		stats.Messages++
+		stats.Saved += savedCount
 
-		// Mark message as processed
-		if err := client.MarkProcessed(msg.UID); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: marking message as processed: %v\n", err)
-		}
+		finishMessage(cfg, client, msg.UID, cfg.PostAction, cfg.MoveTo)
+		return nil
+	})
 
-		// Perform post-action
-		switch cfg.PostAction {
-		case PostActionDelete:
-			if err := client.DeleteMessage(msg.UID); err != nil {
-				fmt.Fprintf(os.Stderr, "Error: deleting message: %v\n", err)
-			}
-		case PostActionMove:
-			if err := client.MoveMessage(msg.UID, cfg.MoveTo); err != nil {
-				fmt.Fprintf(os.Stderr, "Error: moving message: %v\n", err)
-			}
-		}
-	}
+	return stats, err
+}
 
-	if !cfg.Quiet {
-		fmt.Printf("Processed %d message(s), saved %d image(s)\n", len(messages), totalSaved)
+// finishMessage marks a message as processed and then deletes it or moves it
+// to moveTo, as action says. Failures are reported but don't stop processing.
+func finishMessage(cfg *Config, client *MailClient, uid imap.UID, action PostAction, moveTo string) {
+	// Mark message as processed
+	if err := client.MarkProcessed(uid); err != nil {
+		fmt.Fprintf(os.Stderr, "%sError: marking message as processed: %v\n", cfg.logPrefix(), err)
 	}
 
-	// Write JSON output if configured
-	if cfg.JSONOutput != "" && len(jsonOutput) > 0 {
-		if err := writeJSONOutput(cfg.JSONOutput, jsonOutput); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: writing JSON output: %v\n", err)
-			// Don't fail - JSON is supplementary
+	// Perform post-action
+	switch action {
+	case PostActionDelete:
+		if err := client.DeleteMessage(uid); err != nil {
+			fmt.Fprintf(os.Stderr, "%sError: deleting message: %v\n", cfg.logPrefix(), err)
+		}
+	case PostActionMove:
+		if err := client.MoveMessage(uid, moveTo); err != nil {
+			fmt.Fprintf(os.Stderr, "%sError: moving message: %v\n", cfg.logPrefix(), err)
 		}
 	}
+}
 
-	return exitOK
+// saveJSONOutput writes output to path if JSON output is configured and any
+// images were saved. Failures are reported but don't fail the run, since the
+// JSON file is supplementary.
+func saveJSONOutput(path string, output []JSONMessageOutput) {
+	if path == "" || len(output) == 0 {
+		return
+	}
+	if err := writeJSONOutput(path, output); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: writing JSON output: %v\n", err)
+	}
 }
 
 // writeJSONOutput writes processing results to a JSON file
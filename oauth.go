@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+type AuthMethod string
+
+const (
+	AuthPassword    AuthMethod = "password"
+	AuthXOAuth2     AuthMethod = "xoauth2"
+	AuthOAuthBearer AuthMethod = "oauthbearer"
+)
+
+// tokenExpirySkew is how long before its expiry a cached access token is
+// considered stale and refreshed.
+const tokenExpirySkew = 5 * time.Minute
+
+// tokenRequestTimeout bounds a request to the token endpoint, so that an
+// endpoint that stops responding can't hang a run or watch mode.
+const tokenRequestTimeout = 30 * time.Second
+
+// Token is an OAuth2 access token.
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+// valid reports whether the token can be used without refreshing.
+func (t *Token) valid(now time.Time) bool {
+	if t == nil || t.AccessToken == "" {
+		return false
+	}
+	return t.Expiry.IsZero() || now.Add(tokenExpirySkew).Before(t.Expiry)
+}
+
+// TokenSource supplies OAuth2 access tokens.
+type TokenSource interface {
+	Token() (*Token, error)
+}
+
+// NewTokenSource returns the token source described by cfg: a static access
+// token, or a refresh-token flow against cfg.OAuth2TokenURL, optionally
+// cached in cfg.OAuth2TokenCache.
+func NewTokenSource(cfg *Config) TokenSource {
+	if cfg.OAuth2Token != "" {
+		return staticTokenSource{token: cfg.OAuth2Token}
+	}
+
+	refresh := &refreshTokenSource{
+		client:       &http.Client{Timeout: tokenRequestTimeout},
+		tokenURL:     cfg.OAuth2TokenURL,
+		clientID:     cfg.OAuth2ClientID,
+		clientSecret: cfg.OAuth2ClientSecret,
+		refreshToken: cfg.OAuth2RefreshToken,
+	}
+	if cfg.OAuth2TokenCache == "" {
+		return refresh
+	}
+	return &cachedTokenSource{
+		path: cfg.OAuth2TokenCache,
+		src:  refresh,
+		now:  time.Now,
+	}
+}
+
+// staticTokenSource always returns the same access token.
+type staticTokenSource struct {
+	token string
+}
+
+func (s staticTokenSource) Token() (*Token, error) {
+	return &Token{AccessToken: s.token}, nil
+}
+
+// refreshTokenSource exchanges a refresh token for an access token at the
+// provider's token endpoint (RFC 6749 section 6).
+type refreshTokenSource struct {
+	client       *http.Client
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	refreshToken string
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (s *refreshTokenSource) Token() (*Token, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.refreshToken},
+		"client_id":     {s.clientID},
+	}
+	if s.clientSecret != "" {
+		form.Set("client_secret", s.clientSecret)
+	}
+
+	resp, err := s.client.PostForm(s.tokenURL, form)
+	if err != nil {
+		return nil, fmt.Errorf("refreshing OAuth2 token: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var body tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("refreshing OAuth2 token: %s: invalid response: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		msg := body.Error
+		if body.ErrorDescription != "" {
+			msg += ": " + body.ErrorDescription
+		}
+		return nil, fmt.Errorf("refreshing OAuth2 token: %s: %s", resp.Status, msg)
+	}
+	if body.AccessToken == "" {
+		return nil, errors.New("refreshing OAuth2 token: response has no access_token")
+	}
+
+	// Some providers rotate the refresh token on every use
+	if body.RefreshToken != "" {
+		s.refreshToken = body.RefreshToken
+	}
+
+	token := &Token{
+		AccessToken:  body.AccessToken,
+		RefreshToken: s.refreshToken,
+	}
+	if body.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// cachedTokenSource keeps the last token in a file and only refreshes it
+// shortly before it expires.
+type cachedTokenSource struct {
+	path string
+	src  *refreshTokenSource
+	now  func() time.Time
+}
+
+func (s *cachedTokenSource) Token() (*Token, error) {
+	cached, err := readTokenCache(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if cached.valid(s.now()) {
+		return cached, nil
+	}
+
+	// Prefer a rotated refresh token from the cache over the configured one
+	if cached != nil && cached.RefreshToken != "" {
+		s.src.refreshToken = cached.RefreshToken
+	}
+
+	token, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTokenCache(s.path, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func readTokenCache(path string) (*Token, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading token cache: %w", err)
+	}
+
+	var token Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		// A corrupt cache is not fatal; just fetch a new token
+		return nil, nil
+	}
+	return &token, nil
+}
+
+func writeTokenCache(path string, token *Token) error {
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling token cache: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("writing token cache: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("writing token cache: %w", err)
+	}
+	return nil
+}
+
+// xoauth2Client implements the XOAUTH2 SASL mechanism used by Gmail and
+// Microsoft 365.
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func newXOAuth2Client(username, token string) sasl.Client {
+	return &xoauth2Client{username: username, token: token}
+}
+
+func (c *xoauth2Client) Start() (string, []byte, error) {
+	ir := "user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"
+	return "XOAUTH2", []byte(ir), nil
+}
+
+// Next handles the error challenge the server sends when authentication
+// fails. It carries a JSON description of the failure.
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	var status struct {
+		Status string `json:"status"`
+		Scope  string `json:"scope"`
+	}
+	if err := json.Unmarshal(challenge, &status); err != nil || status.Status == "" {
+		return nil, fmt.Errorf("XOAUTH2 authentication error: %s", strings.TrimSpace(string(challenge)))
+	}
+	return nil, fmt.Errorf("XOAUTH2 authentication error (%s)", status.Status)
+}
+
+// newOAuthSASLClient returns the SASL client for an OAuth2 auth method.
+func newOAuthSASLClient(cfg *Config, token string) sasl.Client {
+	if cfg.Auth == AuthOAuthBearer {
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: cfg.Username,
+			Token:    token,
+			Host:     cfg.Server,
+			Port:     cfg.Port,
+		})
+	}
+	return newXOAuth2Client(cfg.Username, token)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTokenServer starts a stand-in OAuth2 token endpoint. Each request is
+// passed to handle, which returns the JSON response body and status code.
+func newTestTokenServer(t *testing.T, handle func(r *http.Request) (int, any)) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parsing token request: %v", err)
+		}
+		status, body := handle(r)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRefreshTokenSource(t *testing.T) {
+	srv := newTestTokenServer(t, func(r *http.Request) (int, any) {
+		if got := r.PostForm.Get("grant_type"); got != "refresh_token" {
+			t.Errorf("expected grant_type refresh_token, got %q", got)
+		}
+		if got := r.PostForm.Get("refresh_token"); got != "refresh-1" {
+			t.Errorf("expected refresh_token refresh-1, got %q", got)
+		}
+		if got := r.PostForm.Get("client_id"); got != "client" {
+			t.Errorf("expected client_id client, got %q", got)
+		}
+		if got := r.PostForm.Get("client_secret"); got != "secret" {
+			t.Errorf("expected client_secret secret, got %q", got)
+		}
+		return http.StatusOK, map[string]any{
+			"access_token": "access-1",
+			"expires_in":   3600,
+			"token_type":   "Bearer",
+		}
+	})
+
+	src := NewTokenSource(&Config{
+		OAuth2TokenURL:     srv.URL,
+		OAuth2ClientID:     "client",
+		OAuth2ClientSecret: "secret",
+		OAuth2RefreshToken: "refresh-1",
+	})
+	token, err := src.Token()
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if token.AccessToken != "access-1" {
+		t.Errorf("expected access token access-1, got %q", token.AccessToken)
+	}
+	if until := time.Until(token.Expiry); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("expected expiry in about an hour, got %s", until)
+	}
+}
+
+func TestRefreshTokenSource_Error(t *testing.T) {
+	srv := newTestTokenServer(t, func(r *http.Request) (int, any) {
+		return http.StatusBadRequest, map[string]any{
+			"error":             "invalid_grant",
+			"error_description": "Token has been expired or revoked.",
+		}
+	})
+
+	src := NewTokenSource(&Config{OAuth2TokenURL: srv.URL, OAuth2RefreshToken: "revoked"})
+	_, err := src.Token()
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("expected error to mention invalid_grant, got %q", err.Error())
+	}
+}
+
+func TestRefreshTokenSource_Timeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(done) })
+
+	src, ok := NewTokenSource(&Config{OAuth2TokenURL: srv.URL, OAuth2RefreshToken: "refresh"}).(*refreshTokenSource)
+	if !ok {
+		t.Fatal("expected a refresh token source")
+	}
+	if src.client.Timeout != tokenRequestTimeout {
+		t.Errorf("expected a %s timeout, got %s", tokenRequestTimeout, src.client.Timeout)
+	}
+
+	// A token endpoint that never answers fails the refresh
+	src.client.Timeout = 50 * time.Millisecond
+	if _, err := src.Token(); err == nil {
+		t.Error("expected a timeout error, got nil")
+	}
+}
+
+func TestCachedTokenSource(t *testing.T) {
+	requests := 0
+	srv := newTestTokenServer(t, func(r *http.Request) (int, any) {
+		requests++
+		if requests == 2 && r.PostForm.Get("refresh_token") != "refresh-2" {
+			t.Errorf("expected rotated refresh token refresh-2, got %q", r.PostForm.Get("refresh_token"))
+		}
+		return http.StatusOK, map[string]any{
+			"access_token":  "access-" + string(rune('0'+requests)),
+			"refresh_token": "refresh-" + string(rune('1'+requests)),
+			"expires_in":    3600,
+		}
+	})
+
+	cachePath := filepath.Join(t.TempDir(), "token.json")
+	now := time.Now()
+	newSource := func() *cachedTokenSource {
+		src := NewTokenSource(&Config{
+			OAuth2TokenURL:     srv.URL,
+			OAuth2RefreshToken: "refresh-1",
+			OAuth2TokenCache:   cachePath,
+		}).(*cachedTokenSource)
+		src.now = func() time.Time { return now }
+		return src
+	}
+
+	token, err := newSource().Token()
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if token.AccessToken != "access-1" || requests != 1 {
+		t.Fatalf("expected fresh token access-1 after 1 request, got %q after %d", token.AccessToken, requests)
+	}
+
+	info, err := os.Stat(cachePath)
+	if err != nil {
+		t.Fatalf("expected token cache to be written: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("expected token cache mode 0600, got %o", perm)
+	}
+
+	// A new process reuses the cached token while it is still valid
+	token, err = newSource().Token()
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if token.AccessToken != "access-1" || requests != 1 {
+		t.Errorf("expected cached token access-1 without a request, got %q after %d", token.AccessToken, requests)
+	}
+
+	// Shortly before expiry the token is refreshed with the rotated refresh token
+	now = now.Add(time.Hour - tokenExpirySkew + time.Second)
+	token, err = newSource().Token()
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if token.AccessToken != "access-2" || requests != 2 {
+		t.Errorf("expected refreshed token access-2 after 2 requests, got %q after %d", token.AccessToken, requests)
+	}
+}
+
+func TestStaticTokenSource(t *testing.T) {
+	token, err := NewTokenSource(&Config{OAuth2Token: "static"}).Token()
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if token.AccessToken != "static" {
+		t.Errorf("expected access token static, got %q", token.AccessToken)
+	}
+}
+
+func TestXOAuth2Client(t *testing.T) {
+	client := newXOAuth2Client("user@example.com", "ya29.token")
+
+	mech, ir, err := client.Start()
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if mech != "XOAUTH2" {
+		t.Errorf("expected mechanism XOAUTH2, got %q", mech)
+	}
+	want := "user=user@example.com\x01auth=Bearer ya29.token\x01\x01"
+	if string(ir) != want {
+		t.Errorf("expected initial response %q, got %q", want, ir)
+	}
+
+	_, err = client.Next([]byte(`{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`))
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected error mentioning status 401, got %v", err)
+	}
+}
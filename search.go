@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// dateLayout is the layout of absolute dates in since and before.
+const dateLayout = "2006-01-02"
+
+// parseSearchDate parses a since or before value: a date like 2024-01-31, or
+// a time before now like 7d, 2w, or 36h.
+func parseSearchDate(s string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation(dateLayout, s, now.Location()); err == nil {
+		return t, nil
+	}
+
+	var ago time.Duration
+	if num, unit, ok := cutDateUnit(s); ok {
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date: %q (use YYYY-MM-DD or a time ago like 7d)", s)
+		}
+		ago = time.Duration(n) * unit
+	} else {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date: %q (use YYYY-MM-DD or a time ago like 7d)", s)
+		}
+		ago = d
+	}
+	if ago < 0 {
+		return time.Time{}, fmt.Errorf("invalid date: %q (a time ago can't be negative)", s)
+	}
+	return now.Add(-ago), nil
+}
+
+// cutDateUnit splits a value like 7d or 2w into its number and the length of
+// its unit.
+func cutDateUnit(s string) (string, time.Duration, bool) {
+	if num, ok := strings.CutSuffix(s, "d"); ok {
+		return num, 24 * time.Hour, true
+	}
+	if num, ok := strings.CutSuffix(s, "w"); ok {
+		return num, 7 * 24 * time.Hour, true
+	}
+	return "", 0, false
+}
+
+// validateSearch checks the settings that narrow down the messages searched
+// for.
+func (c *Config) validateSearch(now time.Time) error {
+	var since, before time.Time
+	var err error
+	if c.Since != "" {
+		if since, err = parseSearchDate(c.Since, now); err != nil {
+			return fmt.Errorf("since: %w", err)
+		}
+	}
+	if c.Before != "" {
+		if before, err = parseSearchDate(c.Before, now); err != nil {
+			return fmt.Errorf("before: %w", err)
+		}
+	}
+	if !since.IsZero() && !before.IsZero() && !since.Before(before) {
+		return errors.New("since must be earlier than before")
+	}
+	if c.LargerThan > 0 && c.SmallerThan > 0 && c.SmallerThan <= c.LargerThan {
+		return errors.New("smaller_than must be greater than larger_than")
+	}
+	for name := range c.Headers {
+		if name == "" || strings.ContainsAny(name, ": ") {
+			return fmt.Errorf("invalid header name in headers: %q", name)
+		}
+	}
+	return nil
+}
+
+// searchCriteria returns the SEARCH criteria for the since, before,
+// subject_contains, larger_than, smaller_than, unseen_only, and headers
+// settings. Relative dates are resolved against now, so that in watch mode
+// the window moves along with each pass.
+func (c *Config) searchCriteria(now time.Time) *imap.SearchCriteria {
+	criteria := &imap.SearchCriteria{}
+	if c.Since != "" {
+		criteria.Since, _ = parseSearchDate(c.Since, now)
+	}
+	if c.Before != "" {
+		criteria.Before, _ = parseSearchDate(c.Before, now)
+	}
+	if c.SubjectContains != "" {
+		criteria.Header = append(criteria.Header, imap.SearchCriteriaHeaderField{Key: "Subject", Value: c.SubjectContains})
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Headers)) {
+		criteria.Header = append(criteria.Header, imap.SearchCriteriaHeaderField{Key: name, Value: c.Headers[name]})
+	}
+	criteria.Larger = int64(c.LargerThan)
+	criteria.Smaller = int64(c.SmallerThan)
+	if c.UnseenOnly {
+		criteria.NotFlag = append(criteria.NotFlag, imap.FlagSeen)
+	}
+	return criteria
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestParseSearchDate(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	tests := map[string]time.Time{
+		"2024-01-31": time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC),
+		"7d":         time.Date(2024, 3, 8, 12, 0, 0, 0, time.UTC),
+		"2w":         time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		"36h":        time.Date(2024, 3, 14, 0, 0, 0, 0, time.UTC),
+		"0d":         now,
+	}
+	for s, want := range tests {
+		got, err := parseSearchDate(s, now)
+		if err != nil {
+			t.Errorf("parseSearchDate(%q) failed: %v", s, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("parseSearchDate(%q) = %v, want %v", s, got, want)
+		}
+	}
+
+	for _, s := range []string{"", "yesterday", "2024-13-01", "xd", "-7d", "31/01/2024"} {
+		if _, err := parseSearchDate(s, now); err == nil {
+			t.Errorf("parseSearchDate(%q): expected an error, got nil", s)
+		}
+	}
+}
+
+func TestValidateSearch(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{"valid", Config{Since: "7d", Before: "1d", LargerThan: 10 * kilobyte, SmallerThan: megabyte, Headers: map[string]string{"List-Id": "photos"}}, ""},
+		{"invalid since", Config{Since: "last week"}, `since: invalid date: "last week"`},
+		{"invalid before", Config{Before: "soon"}, `before: invalid date: "soon"`},
+		{"since after before", Config{Since: "2024-02-01", Before: "2024-01-01"}, "since must be earlier than before"},
+		{"empty size range", Config{LargerThan: megabyte, SmallerThan: megabyte}, "smaller_than must be greater than larger_than"},
+		{"invalid header", Config{Headers: map[string]string{"List Id": "photos"}}, `invalid header name in headers: "List Id"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validateSearch(time.Now())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSearchCriteria(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	cfg := &Config{
+		Since:           "7d",
+		Before:          "2024-03-15",
+		SubjectContains: "Photos",
+		LargerThan:      10 * kilobyte,
+		SmallerThan:     20 * megabyte,
+		UnseenOnly:      true,
+		Headers:         map[string]string{"X-Mailer": "iPhone", "List-Id": "photos"},
+	}
+
+	criteria := cfg.searchCriteria(now)
+	if want := time.Date(2024, 3, 8, 12, 0, 0, 0, time.UTC); !criteria.Since.Equal(want) {
+		t.Errorf("expected since %v, got %v", want, criteria.Since)
+	}
+	if want := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC); !criteria.Before.Equal(want) {
+		t.Errorf("expected before %v, got %v", want, criteria.Before)
+	}
+	if criteria.Larger != 10*1024 || criteria.Smaller != 20*1024*1024 {
+		t.Errorf("expected larger %d and smaller %d, got %d and %d", 10*1024, 20*1024*1024, criteria.Larger, criteria.Smaller)
+	}
+	if len(criteria.NotFlag) != 1 || criteria.NotFlag[0] != imap.FlagSeen {
+		t.Errorf("expected NOT \\Seen, got %v", criteria.NotFlag)
+	}
+	var headers []string
+	for _, h := range criteria.Header {
+		headers = append(headers, h.Key+": "+h.Value)
+	}
+	if got := strings.Join(headers, ", "); got != "Subject: Photos, List-Id: photos, X-Mailer: iPhone" {
+		t.Errorf("unexpected header criteria: %s", got)
+	}
+
+	if criteria := (&Config{}).searchCriteria(now); !criteria.Since.IsZero() || len(criteria.Header) != 0 || len(criteria.NotFlag) != 0 {
+		t.Errorf("expected empty criteria without settings, got %+v", criteria)
+	}
+}
+
+func TestForEachNewMessage_SearchCriteria(t *testing.T) {
+	addr, user := newTestServer(t, nil)
+	m := newTestMailClient(t, addr)
+
+	for _, subject := range []string{"Holiday photos", "Invoice", "More photos"} {
+		appendTestMessage(t, user, "INBOX", strings.Replace(testMessage, "Subject: Test", "Subject: "+subject, 1))
+	}
+
+	m.cfg.SubjectContains = "photos"
+	messages := collectNewMessages(t, m)
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages with photos in the subject, got %d", len(messages))
+	}
+	for _, msg := range messages {
+		if !strings.Contains(msg.Subject, "photos") {
+			t.Errorf("unexpected message %q", msg.Subject)
+		}
+		if err := m.MarkProcessed(msg.UID); err != nil {
+			t.Fatalf("MarkProcessed failed: %v", err)
+		}
+	}
+
+	// The criteria are combined with skipping processed messages
+	if messages := collectNewMessages(t, m); len(messages) != 0 {
+		t.Errorf("expected no new messages, got %d", len(messages))
+	}
+	m.cfg.SubjectContains = ""
+	if messages := collectNewMessages(t, m); len(messages) != 1 || messages[0].Subject != "Invoice" {
+		t.Errorf("expected only the Invoice message to be left, got %v", messages)
+	}
+}
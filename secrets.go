@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// keyringService is the service name passwords are stored under in the
+// operating system's keyring.
+const keyringService = "mailgrab"
+
+// Keyring looks up passwords in the operating system's credential store.
+type Keyring interface {
+	Get(service, user string) (string, error)
+}
+
+// systemKeyring returns the keyring backend for the current platform: the
+// macOS Keychain, or the freedesktop Secret Service elsewhere.
+func systemKeyring() Keyring {
+	if runtime.GOOS == "darwin" {
+		return macKeychain{}
+	}
+	return secretServiceKeyring{}
+}
+
+// secretServiceKeyring reads from the Secret Service (GNOME Keyring,
+// KWallet) using secret-tool. Passwords can be stored with:
+//
+//	secret-tool store --label=mailgrab service mailgrab username USER
+type secretServiceKeyring struct{}
+
+func (secretServiceKeyring) Get(service, user string) (string, error) {
+	return runSecretCommand(exec.Command("secret-tool", "lookup", "service", service, "username", user))
+}
+
+// macKeychain reads from the macOS Keychain using security. Passwords can be
+// stored with:
+//
+//	security add-generic-password -s mailgrab -a USER -w
+type macKeychain struct{}
+
+func (macKeychain) Get(service, user string) (string, error) {
+	return runSecretCommand(exec.Command("security", "find-generic-password", "-s", service, "-a", user, "-w"))
+}
+
+// overridePasswordSource clears the password sources that weren't set along
+// with another one in set, the fields set by a profile, an account, or the
+// environment and flags. The password source given there then replaces the
+// one inherited from the less specific settings, rather than conflicting
+// with it. Sources set to an empty value are ignored.
+func (c *Config) overridePasswordSource(set map[string]bool) {
+	password := set["Password"] && c.Password != ""
+	file := set["PasswordFile"] && c.PasswordFile != ""
+	command := set["PasswordCommand"] && c.PasswordCommand != ""
+	keyring := set["PasswordKeyring"] && c.PasswordKeyring
+	if !password && !file && !command && !keyring {
+		return
+	}
+	if !password {
+		c.Password = ""
+		delete(c.sources, "Password")
+	}
+	if !file {
+		c.PasswordFile = ""
+		delete(c.sources, "PasswordFile")
+	}
+	if !command {
+		c.PasswordCommand = ""
+		delete(c.sources, "PasswordCommand")
+	}
+	if !keyring {
+		c.PasswordKeyring = false
+		delete(c.sources, "PasswordKeyring")
+	}
+}
+
+// resolvePassword fills in cfg.Password from password_file,
+// password_command, or the keyring, whichever is configured. At most one
+// password source may be set at the same level; see overridePasswordSource. Nothing is done for the OAuth2 auth methods.
+func resolvePassword(cfg *Config, keyring Keyring) error {
+	if cfg.Auth != AuthPassword && cfg.Auth != "" {
+		return nil
+	}
+
+	var sources []string
+	if cfg.Password != "" {
+		sources = append(sources, "password")
+	}
+	if cfg.PasswordFile != "" {
+		sources = append(sources, "password_file")
+	}
+	if cfg.PasswordCommand != "" {
+		sources = append(sources, "password_command")
+	}
+	if cfg.PasswordKeyring {
+		sources = append(sources, "password_keyring")
+	}
+	if len(sources) > 1 {
+		return fmt.Errorf("only one password source can be set, got %s", strings.Join(sources, ", "))
+	}
+
+	var (
+		password string
+		err      error
+	)
+	switch {
+	case cfg.PasswordFile != "":
+		password, err = readPasswordFile(cfg.PasswordFile)
+	case cfg.PasswordCommand != "":
+		password, err = runPasswordCommand(cfg.PasswordCommand)
+	case cfg.PasswordKeyring:
+		password, err = keyring.Get(keyringService, cfg.Username)
+		if err != nil {
+			err = fmt.Errorf("reading password for %s from keyring: %w", cfg.Username, err)
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cfg.Password = password
+	cfg.setSource("Password", valueSource(sources[0]))
+	return nil
+}
+
+// readPasswordFile returns the first line of the file at path.
+func readPasswordFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading password_file: %w", err)
+	}
+	password := firstLine(data)
+	if password == "" {
+		return "", fmt.Errorf("password_file %s is empty", path)
+	}
+	return password, nil
+}
+
+// runPasswordCommand runs command with the shell and returns the first line
+// of its output, so tools like "pass show" that print extra lines after the
+// password work as they are.
+func runPasswordCommand(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	// Let the command prompt for a passphrase, e.g. through gpg-agent
+	cmd.Stdin = os.Stdin
+
+	password, err := runSecretCommand(cmd)
+	if err != nil {
+		return "", fmt.Errorf("password_command: %w", err)
+	}
+	return password, nil
+}
+
+// runSecretCommand runs cmd and returns the first line of its output. The
+// output is never included in errors.
+func runSecretCommand(cmd *exec.Cmd) (string, error) {
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	password := firstLine(stdout.Bytes())
+	if password == "" {
+		return "", errors.New("no password returned")
+	}
+	return password, nil
+}
+
+// firstLine returns data up to the first line break.
+func firstLine(data []byte) string {
+	line, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimSuffix(line, "\r")
+}
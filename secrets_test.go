@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeKeyring is an in-memory Keyring keyed by service and user.
+type fakeKeyring map[string]string
+
+func (k fakeKeyring) Get(service, user string) (string, error) {
+	password, ok := k[service+"/"+user]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return password, nil
+}
+
+func TestResolvePassword(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("password_command tests use sh")
+	}
+
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("from-file\nsecond line\n"), 0600); err != nil {
+		t.Fatalf("writing password file: %v", err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyFile, nil, 0600); err != nil {
+		t.Fatalf("writing empty file: %v", err)
+	}
+	keyring := fakeKeyring{"mailgrab/user@example.com": "from-keyring"}
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    string
+		wantErr string
+	}{
+		{
+			name: "plain password",
+			cfg:  Config{Password: "plain"},
+			want: "plain",
+		},
+		{
+			name: "password file",
+			cfg:  Config{PasswordFile: passwordFile},
+			want: "from-file",
+		},
+		{
+			name:    "empty password file",
+			cfg:     Config{PasswordFile: emptyFile},
+			wantErr: "is empty",
+		},
+		{
+			name: "password command",
+			cfg:  Config{PasswordCommand: `printf 'from-command\r\nurl: example.com\n'`},
+			want: "from-command",
+		},
+		{
+			name:    "failing password command",
+			cfg:     Config{PasswordCommand: "echo leaked-secret; exit 3"},
+			wantErr: "password_command: exit status 3",
+		},
+		{
+			name:    "password command without output",
+			cfg:     Config{PasswordCommand: "true"},
+			wantErr: "password_command: no password returned",
+		},
+		{
+			name: "keyring",
+			cfg:  Config{Username: "user@example.com", PasswordKeyring: true},
+			want: "from-keyring",
+		},
+		{
+			name:    "keyring without entry",
+			cfg:     Config{Username: "other@example.com", PasswordKeyring: true},
+			wantErr: "reading password for other@example.com from keyring: not found",
+		},
+		{
+			name:    "several sources",
+			cfg:     Config{Password: "plain", PasswordCommand: "echo other"},
+			wantErr: "only one password source can be set, got password, password_command",
+		},
+		{
+			name: "oauth ignores password sources",
+			cfg:  Config{Auth: AuthXOAuth2, PasswordCommand: "exit 1"},
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			err := resolvePassword(&cfg, keyring)
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error containing %q, got nil", tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected error containing %q, got %q", tt.wantErr, err.Error())
+				}
+				if strings.Contains(err.Error(), "leaked-secret") {
+					t.Errorf("error must not include command output, got %q", err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolvePassword failed: %v", err)
+			}
+			if cfg.Password != tt.want {
+				t.Errorf("expected password %q, got %q", tt.want, cfg.Password)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_PasswordKeyring(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configContent := `server: imap.example.com
+username: user@example.com
+password_keyring: true
+output: /photos
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	keyring := fakeKeyring{"mailgrab/user@example.com": "from-keyring"}
+	cfg, err := loadConfig([]string{"-c", configPath}, keyring)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if cfg.Password != "from-keyring" {
+		t.Errorf("expected password from keyring, got %q", cfg.Password)
+	}
+}
+
+func TestLoadConfig_PasswordSourceOverride(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("failed to write password file: %v", err)
+	}
+	configPath := filepath.Join(dir, "config.yaml")
+	configContent := `username: user@example.com
+password: shared
+output: /photos
+accounts:
+  - name: personal
+    server: imap.example.com
+  - name: work
+    server: imap.work.example.com
+    password_command: echo from-command
+  - name: keyring
+    server: imap.keyring.example.com
+    password_keyring: true
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	// A source set for an account replaces the inherited one
+	keyring := fakeKeyring{"mailgrab/user@example.com": "from-keyring"}
+	cfg, err := loadConfig([]string{"-c", configPath}, keyring)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	for i, want := range []string{"shared", "from-command", "from-keyring"} {
+		if got := cfg.Accounts[i].Password; got != want {
+			t.Errorf("expected password %q for %s, got %q", want, cfg.Accounts[i].Name, got)
+		}
+	}
+
+	// A source set in the environment replaces the config file's
+	t.Setenv("MAILGRAB_PASSWORD_FILE", passwordFile)
+	cfg, err = loadConfig([]string{"-c", configPath}, keyring)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	for _, acct := range cfg.Accounts {
+		if acct.Password != "from-file" {
+			t.Errorf("expected password from the environment's password_file for %s, got %q", acct.Name, acct.Password)
+		}
+	}
+
+	// Sources set at the same level still conflict
+	if err := os.WriteFile(configPath, []byte(configContent+"    password: other\n"), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+	t.Setenv("MAILGRAB_PASSWORD_FILE", "")
+	if _, err := loadConfig([]string{"-c", configPath}, keyring); err == nil || !strings.Contains(err.Error(), "only one password source") {
+		t.Errorf("expected a conflict between sources of the same account, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// senderAllowed reports whether messages from addr should be processed. A
+// sender matching any deny pattern is rejected; otherwise, if there are allow
+// patterns, the sender has to match one of them.
+func senderAllowed(allow, deny []string, addr string) bool {
+	for _, pattern := range deny {
+		if matchSender(pattern, addr) {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, pattern := range allow {
+		if matchSender(pattern, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSender reports whether addr matches pattern, which is an exact
+// address, @domain for every address at that domain, or a glob pattern such
+// as *@*.example.com. Matching is case-insensitive.
+func matchSender(pattern, addr string) bool {
+	pattern = strings.ToLower(pattern)
+	addr = strings.ToLower(addr)
+	switch {
+	case isSenderGlob(pattern):
+		matched, _ := path.Match(pattern, addr)
+		return matched
+	case strings.HasPrefix(pattern, "@"):
+		return strings.HasSuffix(addr, pattern) && strings.Count(addr, "@") == 1
+	default:
+		return addr == pattern
+	}
+}
+
+func isSenderGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// validateSenderPatterns checks the patterns of the allow_senders or
+// deny_senders setting called name.
+func validateSenderPatterns(name string, patterns []string) error {
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return fmt.Errorf("%s cannot contain an empty pattern", name)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern in %s: %s", name, pattern)
+		}
+	}
+	return nil
+}
+
+// senderSearchCriteria returns SEARCH criteria that narrow a search down to
+// messages that may be from one of the allowed senders, so messages from
+// others are never fetched. The server's FROM search matches substrings of
+// the header, so the result still has to be checked with senderAllowed. It
+// returns nil if some pattern is a glob, which SEARCH can't express.
+func senderSearchCriteria(allow []string) *imap.SearchCriteria {
+	if len(allow) == 0 {
+		return nil
+	}
+
+	var criteria []imap.SearchCriteria
+	for _, pattern := range allow {
+		if isSenderGlob(pattern) {
+			return nil
+		}
+		criteria = append(criteria, imap.SearchCriteria{
+			Header: []imap.SearchCriteriaHeaderField{{Key: "From", Value: pattern}},
+		})
+	}
+
+	// Combine the alternatives as OR a (OR b c)
+	result := criteria[len(criteria)-1]
+	for i := len(criteria) - 2; i >= 0; i-- {
+		result = imap.SearchCriteria{Or: [][2]imap.SearchCriteria{{criteria[i], result}}}
+	}
+	return &result
+}
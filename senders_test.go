@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestMatchSender(t *testing.T) {
+	tests := []struct {
+		pattern string
+		addr    string
+		want    bool
+	}{
+		{"alice@example.com", "alice@example.com", true},
+		{"alice@example.com", "Alice@Example.com", true},
+		{"alice@example.com", "malice@example.com", false},
+		{"@example.com", "bob@example.com", true},
+		{"@example.com", "bob@EXAMPLE.COM", true},
+		{"@example.com", "bob@mail.example.com", false},
+		{"@example.com", "bob@example.com.evil", false},
+		{"*@*.example.com", "bob@mail.example.com", true},
+		{"*@*.example.com", "bob@example.com", false},
+		{"scanner-?@office.example.com", "scanner-1@office.example.com", true},
+		{"[a-c]*@example.com", "dave@example.com", false},
+	}
+	for _, tt := range tests {
+		if got := matchSender(tt.pattern, tt.addr); got != tt.want {
+			t.Errorf("matchSender(%q, %q) = %v, want %v", tt.pattern, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestSenderAllowed(t *testing.T) {
+	allow := []string{"@example.com", "friend@gmail.com"}
+	deny := []string{"noreply@example.com"}
+
+	tests := map[string]bool{
+		"alice@example.com":   true,
+		"friend@gmail.com":    true,
+		"stranger@gmail.com":  false,
+		"noreply@example.com": false,
+		"":                    false,
+	}
+	for addr, want := range tests {
+		if got := senderAllowed(allow, deny, addr); got != want {
+			t.Errorf("senderAllowed(%q) = %v, want %v", addr, got, want)
+		}
+	}
+
+	// Without an allow list only denied senders are rejected
+	if !senderAllowed(nil, deny, "stranger@gmail.com") {
+		t.Error("expected senders to be allowed by default")
+	}
+	if senderAllowed(nil, deny, "noreply@example.com") {
+		t.Error("expected a denied sender to be rejected")
+	}
+}
+
+func TestValidateSenderPatterns(t *testing.T) {
+	if err := validateSenderPatterns("allow_senders", []string{"a@example.com", "@example.com", "*@*.example.com"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateSenderPatterns("allow_senders", []string{"[a-@example.com"}); err == nil || !strings.Contains(err.Error(), "invalid pattern in allow_senders") {
+		t.Errorf("expected an invalid pattern error, got %v", err)
+	}
+	if err := validateSenderPatterns("deny_senders", []string{""}); err == nil {
+		t.Error("expected an error for an empty pattern, got nil")
+	}
+}
+
+func TestSenderSearchCriteria(t *testing.T) {
+	if c := senderSearchCriteria(nil); c != nil {
+		t.Errorf("expected no criteria without an allow list, got %+v", c)
+	}
+	if c := senderSearchCriteria([]string{"@example.com", "*@*.example.com"}); c != nil {
+		t.Errorf("expected no criteria when a pattern is a glob, got %+v", c)
+	}
+
+	c := senderSearchCriteria([]string{"a@example.com"})
+	if c == nil || len(c.Header) != 1 || c.Header[0].Value != "a@example.com" {
+		t.Errorf("expected a single FROM criterion, got %+v", c)
+	}
+
+	c = senderSearchCriteria([]string{"a@example.com", "@b.example.com", "c@example.com"})
+	if c == nil || len(c.Or) != 1 {
+		t.Fatalf("expected an OR of the patterns, got %+v", c)
+	}
+	var values []string
+	var collect func(c imap.SearchCriteria)
+	collect = func(c imap.SearchCriteria) {
+		for _, h := range c.Header {
+			values = append(values, h.Value)
+		}
+		for _, or := range c.Or {
+			collect(or[0])
+			collect(or[1])
+		}
+	}
+	collect(*c)
+	if strings.Join(values, " ") != "a@example.com @b.example.com c@example.com" {
+		t.Errorf("unexpected FROM criteria: %v", values)
+	}
+}
+
+func TestProcessNewMessages_Senders(t *testing.T) {
+	tests := []struct {
+		name         string
+		allow        []string
+		action       PostAction
+		wantMessages int
+		wantJunk     uint32
+	}{
+		// The allow list is sent to the server, so the rejected message is
+		// never fetched
+		{"searched", []string{"friend@example.com"}, PostActionNone, 1, 0},
+		// Globs are only checked after fetching the envelope
+		{"glob", []string{"friend@*"}, PostActionNone, 2, 0},
+		{"rejected action", []string{"friend@example.com"}, PostActionMove, 2, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, user := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+			for _, name := range []string{"friend", "spam"} {
+				raw := strings.Replace(testImageMessage(name+".jpg", []byte("\xff\xd8\xff\xe0")), "sender@", name+"@", 1)
+				appendTestMessage(t, user, "INBOX", raw)
+			}
+			if err := user.Create("Junk", nil); err != nil {
+				t.Fatalf("creating mailbox: %v", err)
+			}
+
+			cfg := newTestConfig(t, addr)
+			cfg.AllowSenders = tt.allow
+			cfg.RejectedAction = tt.action
+			cfg.RejectedMoveTo = "Junk"
+
+			stats, code := runOnce(context.Background(), cfg, func(string, ...any) {})
+			if code != exitOK {
+				t.Fatalf("runOnce returned %d, want %d", code, exitOK)
+			}
+			if stats.Messages != tt.wantMessages || stats.Saved != 1 {
+				t.Errorf("expected %d message(s) and 1 image, got %+v", tt.wantMessages, stats)
+			}
+			if _, err := os.Stat(filepath.Join(cfg.Output, "friend.jpg")); err != nil {
+				t.Errorf("expected the allowed sender's image to be saved: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(cfg.Output, "spam.jpg")); !os.IsNotExist(err) {
+				t.Errorf("expected the rejected sender's image not to be saved, got %v", err)
+			}
+
+			data, err := newTestMailClient(t, addr).Examine("Junk")
+			if err != nil {
+				t.Fatalf("examining Junk: %v", err)
+			}
+			if data.NumMessages != tt.wantJunk {
+				t.Errorf("expected %d message(s) in Junk, got %d", tt.wantJunk, data.NumMessages)
+			}
+		})
+	}
+}
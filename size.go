@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ByteSize is a number of bytes. In flags and the config file it can be
+// given with a unit, like 500K or 2.5MB, where K, M, and G are powers of
+// 1024.
+type ByteSize int64
+
+const (
+	kilobyte ByteSize = 1 << (10 * (iota + 1))
+	megabyte
+	gigabyte
+)
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"G", gigabyte},
+	{"M", megabyte},
+	{"K", kilobyte},
+	{"", 1},
+}
+
+// parseByteSize parses a size like 1024, 500K, 500KB, 500KiB, or 2.5M.
+func parseByteSize(s string) (ByteSize, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+	for _, unit := range byteSizeUnits {
+		num, ok := strings.CutSuffix(str, unit.suffix)
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+		size := n * float64(unit.size)
+		// ParseFloat also accepts NaN, Inf, and sizes too large for an
+		// int64, which don't convert to one
+		if err != nil || math.IsNaN(size) || size < 0 || size >= math.MaxInt64 {
+			break
+		}
+		return ByteSize(size), nil
+	}
+	return 0, fmt.Errorf("invalid size: %q (use bytes or a unit, like 500K or 2MB)", s)
+}
+
+// String formats the size with the largest unit that divides it exactly.
+func (b ByteSize) String() string {
+	for _, unit := range byteSizeUnits {
+		if unit.size > 1 && b != 0 && b%unit.size == 0 {
+			return fmt.Sprintf("%d%sB", b/unit.size, unit.suffix)
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+// UnmarshalFlag implements flags.Unmarshaler.
+func (b *ByteSize) UnmarshalFlag(value string) error {
+	n, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*b = n
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return errors.New("size must be a number or a string like 500K")
+	}
+	return b.UnmarshalFlag(node.Value)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := map[string]ByteSize{
+		"0":      0,
+		"1024":   1024,
+		"1024B":  1024,
+		"500K":   500 * 1024,
+		"500kb":  500 * 1024,
+		"500KiB": 500 * 1024,
+		"2.5M":   2*1024*1024 + 512*1024,
+		"1 GB":   1024 * 1024 * 1024,
+		"1e3K":   1000 * 1024,
+	}
+	for s, want := range tests {
+		got, err := parseByteSize(s)
+		if err != nil {
+			t.Errorf("parseByteSize(%q) failed: %v", s, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("parseByteSize(%q) = %d, want %d", s, got, want)
+		}
+	}
+
+	for _, s := range []string{"", "K", "-1", "ten", "5T", "NaN", "InfK", "-Inf", "1e30", "8796093022208G"} {
+		if _, err := parseByteSize(s); err == nil {
+			t.Errorf("parseByteSize(%q): expected an error, got nil", s)
+		}
+	}
+}
+
+func TestByteSize_String(t *testing.T) {
+	tests := map[ByteSize]string{
+		0:               "0",
+		1000:            "1000",
+		2048:            "2KB",
+		5 * megabyte:    "5MB",
+		gigabyte:        "1GB",
+		megabyte + 1024: "1025KB",
+	}
+	for size, want := range tests {
+		if got := size.String(); got != want {
+			t.Errorf("ByteSize(%d).String() = %q, want %q", int64(size), got, want)
+		}
+	}
+}
+
+func TestLoadConfig_ByteSize(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configContent := `server: imap.example.com
+username: user
+password: pass
+output: /photos
+larger_than: 100K
+smaller_than: 1048576
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	cfg, err := loadConfig([]string{"-c", configPath}, nil)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if cfg.LargerThan != 100*kilobyte || cfg.SmallerThan != megabyte {
+		t.Errorf("expected sizes from the file, got larger_than %d, smaller_than %d", cfg.LargerThan, cfg.SmallerThan)
+	}
+
+	cfg, err = loadConfig([]string{"-c", configPath, "--smaller-than", "20M"}, nil)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if cfg.SmallerThan != 20*megabyte {
+		t.Errorf("expected the flag to override smaller_than, got %d", cfg.SmallerThan)
+	}
+
+	if err := os.WriteFile(configPath, []byte(strings.Replace(configContent, "100K", "lots", 1)), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+	if _, err := loadConfig([]string{"-c", configPath}, nil); err == nil || !strings.Contains(err.Error(), `invalid size: "lots"`) {
+		t.Errorf("expected an invalid size error, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type TypeDetection string
+
+const (
+	TypeDetectionHeader  TypeDetection = "header"
+	TypeDetectionContent TypeDetection = "content"
+	TypeDetectionBoth    TypeDetection = "both"
+)
+
+// sniffLen is how many bytes at the start of an attachment are looked at to
+// detect its type.
+const sniffLen = 64
+
+// ErrNotImage is returned when the content of an attachment shows it isn't
+// an image, whatever its MIME type says.
+var ErrNotImage = errors.New("content is not an image")
+
+// imageType is a file format that can be recognized by its first bytes.
+type imageType struct {
+	MIMEType string
+	// Exts are the file extensions used for the format, the usual one
+	// first.
+	Exts []string
+}
+
+var (
+	typeJPEG = imageType{"image/jpeg", []string{".jpg", ".jpeg", ".jpe", ".jfif"}}
+	typePNG  = imageType{"image/png", []string{".png"}}
+	typeGIF  = imageType{"image/gif", []string{".gif"}}
+	typeWebP = imageType{"image/webp", []string{".webp"}}
+	typeBMP  = imageType{"image/bmp", []string{".bmp", ".dib"}}
+	// Many camera RAW formats are TIFF files that can only be told apart by
+	// their extension
+	typeTIFF = imageType{"image/tiff", []string{".tif", ".tiff", ".dng", ".nef", ".nrw", ".arw", ".srf", ".sr2", ".pef", ".srw", ".3fr", ".erf", ".kdc", ".mos", ".iiq", ".rwl"}}
+	typeCR2  = imageType{"image/x-canon-cr2", []string{".cr2"}}
+	typeCR3  = imageType{"image/x-canon-cr3", []string{".cr3"}}
+	typeORF  = imageType{"image/x-olympus-orf", []string{".orf"}}
+	typeRW2  = imageType{"image/x-panasonic-rw2", []string{".rw2", ".raw"}}
+	typeRAF  = imageType{"image/x-fuji-raf", []string{".raf"}}
+	typeHEIC = imageType{"image/heic", []string{".heic", ".heif"}}
+	typeHEIF = imageType{"image/heif", []string{".heif", ".heic"}}
+	typeAVIF = imageType{"image/avif", []string{".avif"}}
+
+	imageTypes = []imageType{typeJPEG, typePNG, typeGIF, typeWebP, typeBMP, typeTIFF, typeCR2, typeCR3, typeORF, typeRW2, typeRAF, typeHEIC, typeHEIF, typeAVIF}
+)
+
+// sniffImageType returns the image format of a file starting with header.
+func sniffImageType(header []byte) (imageType, bool) {
+	switch {
+	case bytes.HasPrefix(header, []byte("\xff\xd8\xff")):
+		return typeJPEG, true
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return typePNG, true
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return typeGIF, true
+	case len(header) >= 12 && bytes.HasPrefix(header, []byte("RIFF")) && string(header[8:12]) == "WEBP":
+		return typeWebP, true
+	case bytes.HasPrefix(header, []byte("BM")) && len(header) >= 14 && header[6] == 0 && header[7] == 0 && header[8] == 0 && header[9] == 0:
+		// The reserved fields of the BMP file header are zero
+		return typeBMP, true
+	case bytes.HasPrefix(header, []byte("FUJIFILMCCD-RAW")):
+		return typeRAF, true
+	case bytes.HasPrefix(header, []byte("IIRO")), bytes.HasPrefix(header, []byte("IIRS")), bytes.HasPrefix(header, []byte("MMOR")):
+		return typeORF, true
+	case bytes.HasPrefix(header, []byte("IIU\x00")):
+		return typeRW2, true
+	case bytes.HasPrefix(header, []byte("II*\x00")) && len(header) >= 10 && string(header[8:10]) == "CR":
+		return typeCR2, true
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		return typeTIFF, true
+	}
+	return sniffISOBMFF(header)
+}
+
+// sniffISOBMFF recognizes the image formats stored in ISO base media files
+// by the brands in their ftyp box.
+func sniffISOBMFF(header []byte) (imageType, bool) {
+	if len(header) < 16 || string(header[4:8]) != "ftyp" {
+		return imageType{}, false
+	}
+	size := int(header[0])<<24 | int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+	size = min(size, len(header))
+
+	// The major brand, then the compatible brands after the minor version
+	brands := []string{string(header[8:12])}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(header[i:i+4]))
+	}
+
+	has := func(want ...string) bool {
+		return slices.ContainsFunc(brands, func(b string) bool { return slices.Contains(want, b) })
+	}
+	switch {
+	case has("crx "):
+		return typeCR3, true
+	case has("avif", "avis"):
+		return typeAVIF, true
+	case has("heic", "heix", "hevc", "hevx", "heim", "heis"):
+		return typeHEIC, true
+	case has("mif1", "msf1"):
+		return typeHEIF, true
+	}
+	return imageType{}, false
+}
+
+// hasImageExtension reports whether filename has the extension of a known
+// image format.
+func hasImageExtension(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == "" {
+		return false
+	}
+	return slices.ContainsFunc(imageTypes, func(t imageType) bool { return slices.Contains(t.Exts, ext) })
+}
+
+// fixExtension makes sure filename has an extension of type t. A wrong image
+// extension is replaced; any other extension is kept and the right one
+// appended.
+func fixExtension(filename string, t imageType) string {
+	ext := filepath.Ext(filename)
+	if slices.Contains(t.Exts, strings.ToLower(ext)) {
+		return filename
+	}
+	if hasImageExtension(filename) {
+		filename = strings.TrimSuffix(filename, ext)
+	}
+	return filename + t.Exts[0]
+}
+
+// peekAttachment returns the first bytes of att, whose Data must be set, to
+// detect its type from, and att with Data replaced by a reader of the same
+// data.
+func peekAttachment(att Attachment) (Attachment, []byte, error) {
+	r := bufio.NewReaderSize(att.Data, sniffLen)
+	header, err := r.Peek(sniffLen)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return att, nil, err
+	}
+	att.Data = r
+	return att, header, nil
+}
+
+// recognizableImage reports whether mimeType or filename names an image
+// format that sniffImageType recognizes, so that content it doesn't recognize
+// can't be of that format.
+func recognizableImage(mimeType, filename string) bool {
+	return hasImageExtension(filename) || slices.ContainsFunc(imageTypes, func(t imageType) bool {
+		return strings.EqualFold(t.MIMEType, mimeType)
+	})
+}
+
+// nonImageSignatures are the first bytes of common formats that are
+// certainly not images.
+var nonImageSignatures = []string{
+	"MZ",                               // Windows executables
+	"\x7fELF",                          // Linux executables
+	"\xca\xfe\xba\xbe",                 // Mach-O universal binaries
+	"\xcf\xfa\xed\xfe",                 // Mach-O 64-bit executables
+	"\xce\xfa\xed\xfe",                 // Mach-O 32-bit executables
+	"#!",                               // scripts
+	"%PDF-",                            // PDF documents
+	"PK\x03\x04",                       // ZIP archives and Office documents
+	"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", // older Office documents
+	"Rar!\x1a\x07",                     // RAR archives
+	"7z\xbc\xaf\x27\x1c",               // 7-Zip archives
+	"\x1f\x8b",                         // gzip
+}
+
+// sniffNotImage reports whether header is the start of a file that is
+// certainly not an image, like an executable, an archive or an HTML page.
+func sniffNotImage(header []byte) bool {
+	for _, sig := range nonImageSignatures {
+		if bytes.HasPrefix(header, []byte(sig)) {
+			return true
+		}
+	}
+	text := bytes.ToLower(bytes.TrimLeft(header, " \t\r\n\ufeff"))
+	for _, tag := range []string{"<!doctype html", "<html", "<script"} {
+		if bytes.HasPrefix(text, []byte(tag)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGenericMIME reports whether mimeType says nothing about the content, as
+// used by mail clients that don't know the type of a file.
+func isGenericMIME(mimeType string) bool {
+	switch strings.ToLower(mimeType) {
+	case "application/octet-stream", "application/binary", "application/x-download", "application/force-download":
+		return true
+	}
+	return false
+}
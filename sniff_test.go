@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// ftyp returns the start of an ISO base media file with the given brands.
+func ftyp(major string, compatible ...string) []byte {
+	box := []byte(major + "\x00\x00\x00\x00" + strings.Join(compatible, ""))
+	size := 8 + len(box)
+	return append([]byte{0, 0, 0, byte(size), 'f', 't', 'y', 'p'}, box...)
+}
+
+func TestSniffImageType(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"jpeg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF"), "image/jpeg"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "image/png"},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), "image/gif"},
+		{"webp", []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), "image/webp"},
+		{"bmp", []byte("BM\x36\x00\x0c\x00\x00\x00\x00\x00\x36\x00\x00\x00"), "image/bmp"},
+		{"tiff little endian", []byte("II*\x00\x08\x00\x00\x00\x00\x00"), "image/tiff"},
+		{"tiff big endian", []byte("MM\x00*\x00\x00\x00\x08\x00\x00"), "image/tiff"},
+		{"cr2", []byte("II*\x00\x10\x00\x00\x00CR\x02\x00"), "image/x-canon-cr2"},
+		{"orf", []byte("IIRO\x08\x00\x00\x00"), "image/x-olympus-orf"},
+		{"rw2", []byte("IIU\x00\x18\x00\x00\x00"), "image/x-panasonic-rw2"},
+		{"raf", []byte("FUJIFILMCCD-RAW 0201"), "image/x-fuji-raf"},
+		{"heic", ftyp("heic", "mif1", "heic"), "image/heic"},
+		{"heif", ftyp("mif1", "mif1"), "image/heif"},
+		{"avif", ftyp("avif", "mif1", "avif"), "image/avif"},
+		{"avif in heif", ftyp("mif1", "mif1", "avif"), "image/avif"},
+		{"cr3", ftyp("crx ", "crx ", "isom"), "image/x-canon-cr3"},
+		{"mp4", ftyp("isom", "isom", "mp41"), ""},
+		{"exe", []byte("MZ\x90\x00\x03\x00\x00\x00"), ""},
+		{"pdf", []byte("%PDF-1.7\n"), ""},
+		{"text", []byte("BMW owners club newsletter"), ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		got, ok := sniffImageType(tt.header)
+		if ok != (tt.want != "") || got.MIMEType != tt.want {
+			t.Errorf("%s: sniffImageType = %q, %v; want %q", tt.name, got.MIMEType, ok, tt.want)
+		}
+	}
+}
+
+func TestFixExtension(t *testing.T) {
+	tests := []struct {
+		filename string
+		typ      imageType
+		want     string
+	}{
+		{"photo.jpg", typeJPEG, "photo.jpg"},
+		{"photo.JPEG", typeJPEG, "photo.JPEG"},
+		{"photo.png", typeJPEG, "photo.jpg"},
+		{"IMG_1234", typeJPEG, "IMG_1234.jpg"},
+		{"scan.dat", typePNG, "scan.dat.png"},
+		{"DSC_0001.NEF", typeTIFF, "DSC_0001.NEF"},
+		{"IMG_0001.heic", typeHEIF, "IMG_0001.heic"},
+	}
+	for _, tt := range tests {
+		if got := fixExtension(tt.filename, tt.typ); got != tt.want {
+			t.Errorf("fixExtension(%q, %s) = %q, want %q", tt.filename, tt.typ.MIMEType, got, tt.want)
+		}
+	}
+}
+
+func TestTypeFilterCheck_Images(t *testing.T) {
+	jpeg := "\xff\xd8\xff\xe0 jpeg data"
+	filter := func(policy TypeDetection) TypeFilter {
+		return TypeFilter{Include: defaultIncludeTypes, Detection: policy}
+	}
+
+	// The header policy trusts the MIME type without reading anything
+	att := Attachment{Filename: "virus.jpg", MIMEType: "image/jpeg", Data: strings.NewReader("MZ")}
+	if got, err := filter(TypeDetectionHeader).Check(att); err != nil || got.Data != att.Data {
+		t.Errorf("expected the header policy to leave the attachment alone, got %+v, %v", got, err)
+	}
+
+	for _, policy := range []TypeDetection{TypeDetectionContent, TypeDetectionBoth} {
+		att := Attachment{Filename: "virus.jpg", MIMEType: "image/jpeg", Data: strings.NewReader("MZ\x90\x00")}
+		if _, err := filter(policy).Check(att); !errors.Is(err, ErrNotImage) {
+			t.Errorf("%s: expected ErrNotImage for an executable, got %v", policy, err)
+		}
+
+		att = Attachment{Filename: "photo.png", MIMEType: "application/octet-stream", Data: strings.NewReader(jpeg)}
+		got, err := filter(policy).Check(att)
+		if err != nil {
+			t.Fatalf("%s: Check failed: %v", policy, err)
+		}
+		if got.Filename != "photo.jpg" || got.MIMEType != "image/jpeg" {
+			t.Errorf("%s: expected photo.jpg as image/jpeg, got %s as %s", policy, got.Filename, got.MIMEType)
+		}
+		// The sniffed bytes are still read
+		data, err := io.ReadAll(got.Data)
+		if err != nil || string(data) != jpeg {
+			t.Errorf("%s: expected the whole content to be read, got %q, %v", policy, data, err)
+		}
+	}
+}
+
+func TestTypeFilterCheck_UnrecognizedImages(t *testing.T) {
+	tests := []struct {
+		filename, mimeType, content string
+		want                        error
+	}{
+		{"logo.svg", "image/svg+xml", "<svg/>", nil},
+		{"favicon.ico", "image/x-icon", "\x00\x00\x01\x00", nil},
+		{"photo.jxl", "image/jxl", "\xff\x0a", nil},
+		// Content that is certainly something else
+		{"logo.svg", "image/svg+xml", "MZ\x90\x00", ErrNotImage},
+		{"logo.svg", "image/svg+xml", "\n<!DOCTYPE html>", ErrNotImage},
+		{"photo.jxl", "image/jxl", "PK\x03\x04", ErrNotImage},
+		// Formats that are recognized must be what they claim
+		{"photo", "image/jpeg", "\x00\x00\x01\x00", ErrNotImage},
+		{"favicon.png", "image/x-icon", "\x00\x00\x01\x00", ErrNotImage},
+	}
+
+	for _, policy := range []TypeDetection{TypeDetectionContent, TypeDetectionBoth} {
+		filter := TypeFilter{Include: defaultIncludeTypes, Detection: policy}
+		for _, tt := range tests {
+			att := Attachment{Filename: tt.filename, MIMEType: tt.mimeType, Data: strings.NewReader(tt.content)}
+			got, err := filter.Check(att)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%s: Check(%s as %s) = %v, want %v", policy, tt.filename, tt.mimeType, err, tt.want)
+			}
+			if err == nil && (got.Filename != tt.filename || got.MIMEType != tt.mimeType) {
+				t.Errorf("%s: expected %s to be kept as is, got %s as %s", policy, tt.filename, got.Filename, got.MIMEType)
+			}
+		}
+	}
+}
+
+func TestProcessNewMessages_TypeDetection(t *testing.T) {
+	addr, user := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+	// A photo sent without a type, and an executable pretending to be one
+	photo := strings.Replace(testImageMessage("IMG_0001", []byte("\xff\xd8\xff\xe0photo")), "image/jpeg", "application/octet-stream", 1)
+	appendTestMessage(t, user, "INBOX", photo)
+	appendTestMessage(t, user, "INBOX", testImageMessage("cute.jpg", []byte("MZ\x90\x00\x03")))
+	// An SVG, which isn't recognized by its content, and a web page
+	// pretending to be one
+	svg := `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`
+	appendTestMessage(t, user, "INBOX", strings.Replace(testImageMessage("logo.svg", []byte(svg)), "image/jpeg", "image/svg+xml", 1))
+	appendTestMessage(t, user, "INBOX", strings.Replace(testImageMessage("icon.svg", []byte("<html><script>")), "image/jpeg", "image/svg+xml", 1))
+
+	cfg := newTestConfig(t, addr)
+
+	stats, code := runOnce(context.Background(), cfg, func(string, ...any) {})
+	if code != exitOK {
+		t.Fatalf("runOnce returned %d, want %d", code, exitOK)
+	}
+	if stats.Messages != 4 || stats.Saved != 2 {
+		t.Errorf("expected 4 messages and 2 images, got %+v", stats)
+	}
+	if data, err := os.ReadFile(filepath.Join(cfg.Output, "logo.svg")); err != nil || string(data) != svg {
+		t.Errorf("expected the SVG to be saved as is, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Output, "icon.svg")); !os.IsNotExist(err) {
+		t.Errorf("expected the web page not to be saved, got %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(cfg.Output, "IMG_0001.jpg"))
+	if err != nil {
+		t.Fatalf("expected the photo to be saved with a .jpg extension: %v", err)
+	}
+	if !bytes.Equal(data, []byte("\xff\xd8\xff\xe0photo")) {
+		t.Errorf("unexpected photo content %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Output, "cute.jpg")); !os.IsNotExist(err) {
+		t.Errorf("expected the executable not to be saved, got %v", err)
+	}
+}
+
+// countingListener counts the bytes written to the connections it accepts.
+type countingListener struct {
+	net.Listener
+	written atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, written: &l.written}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestProcessNewMessages_TypeDetectionPeek(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	counter := &countingListener{Listener: ln}
+	user := serveTestIMAP(t, counter, imap.CapSet{imap.CapIMAP4rev1: {}})
+
+	// A large archive and a photo, both sent without a type
+	archive := bytes.Repeat([]byte("PK\x03\x04"), 256*1024)
+	for name, data := range map[string][]byte{"backup.zip": archive, "IMG_0001": []byte("\xff\xd8\xff\xe0photo")} {
+		appendTestMessage(t, user, "INBOX", strings.Replace(testImageMessage(name, data), "image/jpeg", "application/octet-stream", 1))
+	}
+
+	cfg := newTestConfig(t, ln.Addr().String())
+
+	stats, code := runOnce(context.Background(), cfg, func(string, ...any) {})
+	if code != exitOK {
+		t.Fatalf("runOnce returned %d, want %d", code, exitOK)
+	}
+	if stats.Messages != 2 || stats.Saved != 1 {
+		t.Errorf("expected 2 messages and 1 image, got %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Output, "IMG_0001.jpg")); err != nil {
+		t.Errorf("expected the photo to be saved: %v", err)
+	}
+	// Only the start of the archive is fetched to see it isn't an image
+	if n := counter.written.Load(); n > int64(len(archive)/10) {
+		t.Errorf("expected only the start of the archive to be fetched, the server sent %d bytes", n)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+type StateMode string
+
+const (
+	StateAuto    StateMode = "auto"
+	StateKeyword StateMode = "keyword"
+	StateFile    StateMode = "file"
+)
+
+// StateStore records processed message UIDs in a local file, for servers
+// where the mailgrab-seen keyword can't be stored on the message itself.
+// UIDs are tracked per account and mailbox and are only meaningful for the
+// mailbox's current UIDVALIDITY. A StateStore is safe for concurrent use,
+// so that accounts processed at the same time can share one.
+type StateStore struct {
+	path string
+
+	mu        sync.Mutex
+	mailboxes map[string]*mailboxState
+}
+
+type mailboxState struct {
+	UIDValidity uint32     `json:"uid_validity"`
+	UIDs        []imap.UID `json:"uids"`
+}
+
+type stateFileData struct {
+	Mailboxes map[string]*mailboxState `json:"mailboxes"`
+}
+
+// LoadStateStore reads the state file at path. A missing file yields an empty
+// store.
+func LoadStateStore(path string) (*StateStore, error) {
+	s := &StateStore{
+		path:      path,
+		mailboxes: make(map[string]*mailboxState),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading state file: %w", err)
+	}
+
+	var file stateFileData
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing state file %s: %w", path, err)
+	}
+	// The file may have been edited or merged by hand, so drop empty
+	// entries and restore the sorted order lookups rely on
+	for key, mbox := range file.Mailboxes {
+		if mbox == nil {
+			continue
+		}
+		slices.Sort(mbox.UIDs)
+		mbox.UIDs = slices.Compact(mbox.UIDs)
+		s.mailboxes[key] = mbox
+	}
+
+	return s, nil
+}
+
+// stateStores shares one StateStore per state file between the accounts
+// processed together. Each writes the whole file, so separate stores for the
+// same file would drop each other's entries.
+type stateStores struct {
+	mu     sync.Mutex
+	stores map[string]*StateStore
+}
+
+// Load returns the store for the state file at path, reading it the first
+// time.
+func (s *stateStores) Load(path string) (*StateStore, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := filepath.Clean(path)
+	if abs, err := filepath.Abs(path); err == nil {
+		key = abs
+	}
+	if store, ok := s.stores[key]; ok {
+		return store, nil
+	}
+	store, err := LoadStateStore(path)
+	if err != nil {
+		return nil, err
+	}
+	if s.stores == nil {
+		s.stores = make(map[string]*StateStore)
+	}
+	s.stores[key] = store
+	return store, nil
+}
+
+// loadStateStore reads the state file of c, or returns the store already
+// shared by the accounts processed together with c.
+func (c *Config) loadStateStore() (*StateStore, error) {
+	if c.stateStores == nil {
+		return LoadStateStore(c.StateFile)
+	}
+	return c.stateStores.Load(c.StateFile)
+}
+
+// stateKey identifies a mailbox on a particular account.
+func stateKey(username, server, mailbox string) string {
+	return username + "@" + server + "/" + mailbox
+}
+
+// CheckUIDValidity compares uidValidity with the value recorded for key. If
+// they differ, the recorded UIDs no longer refer to the same messages and are
+// discarded. It returns the number of UIDs that were discarded.
+func (s *StateStore) CheckUIDValidity(key string, uidValidity uint32) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mbox, ok := s.mailboxes[key]
+	if !ok || mbox.UIDValidity == uidValidity {
+		return 0
+	}
+	n := len(mbox.UIDs)
+	s.mailboxes[key] = &mailboxState{UIDValidity: uidValidity}
+	return n
+}
+
+// Tracks reports whether UIDs are recorded for key.
+func (s *StateStore) Tracks(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mbox, ok := s.mailboxes[key]
+	return ok && len(mbox.UIDs) > 0
+}
+
+// IsProcessed reports whether uid has been recorded as processed.
+func (s *StateStore) IsProcessed(key string, uidValidity uint32, uid imap.UID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mbox, ok := s.mailboxes[key]
+	if !ok || mbox.UIDValidity != uidValidity {
+		return false
+	}
+	_, found := slices.BinarySearch(mbox.UIDs, uid)
+	return found
+}
+
+// MarkProcessed records uid as processed and writes the state file.
+func (s *StateStore) MarkProcessed(key string, uidValidity uint32, uid imap.UID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mbox, ok := s.mailboxes[key]
+	if !ok || mbox.UIDValidity != uidValidity {
+		mbox = &mailboxState{UIDValidity: uidValidity}
+		s.mailboxes[key] = mbox
+	}
+
+	i, found := slices.BinarySearch(mbox.UIDs, uid)
+	if found {
+		return nil
+	}
+	mbox.UIDs = slices.Insert(mbox.UIDs, i, uid)
+
+	return s.save()
+}
+
+// save atomically replaces the state file with the current state. s.mu must
+// be held.
+func (s *StateStore) save() error {
+	data, err := json.MarshalIndent(stateFileData{Mailboxes: s.mailboxes}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling state: %w", err)
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating state directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".state-*.tmp")
+	if err != nil {
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("writing state file: %w", err)
+	}
+
+	return nil
+}
+
+// canStoreKeyword reports whether a mailbox with the given PERMANENTFLAGS
+// lets us store the mailgrab-seen keyword on messages.
+func canStoreKeyword(permanentFlags []imap.Flag) bool {
+	for _, flag := range permanentFlags {
+		if flag == imap.FlagWildcard || flag == seenKeyword {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultStatePath returns the default location of the state file,
+// following the XDG base directory spec.
+func defaultStatePath() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "mailgrab", "state.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "mailgrab-state.json"
+	}
+	return filepath.Join(home, ".local", "state", "mailgrab", "state.json")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "state.json")
+	key := stateKey("user", "imap.example.com", "INBOX")
+
+	s, err := LoadStateStore(path)
+	if err != nil {
+		t.Fatalf("LoadStateStore failed: %v", err)
+	}
+	if s.IsProcessed(key, 1, 10) {
+		t.Error("expected empty store to have no processed messages")
+	}
+
+	for _, uid := range []imap.UID{10, 3, 7, 3} {
+		if err := s.MarkProcessed(key, 1, uid); err != nil {
+			t.Fatalf("MarkProcessed failed: %v", err)
+		}
+	}
+
+	// Reload from disk
+	s, err = LoadStateStore(path)
+	if err != nil {
+		t.Fatalf("LoadStateStore failed: %v", err)
+	}
+	for _, uid := range []imap.UID{3, 7, 10} {
+		if !s.IsProcessed(key, 1, uid) {
+			t.Errorf("expected UID %d to be processed", uid)
+		}
+	}
+	if s.IsProcessed(key, 1, 5) {
+		t.Error("expected UID 5 not to be processed")
+	}
+	if s.IsProcessed(stateKey("user", "imap.example.com", "Archive"), 1, 3) {
+		t.Error("expected other mailbox not to share processed UIDs")
+	}
+	if got := s.mailboxes[key].UIDs; len(got) != 3 {
+		t.Errorf("expected 3 unique UIDs, got %v", got)
+	}
+}
+
+func TestStateStore_UIDValidityReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	key := stateKey("user", "imap.example.com", "INBOX")
+
+	s, err := LoadStateStore(path)
+	if err != nil {
+		t.Fatalf("LoadStateStore failed: %v", err)
+	}
+	for _, uid := range []imap.UID{1, 2} {
+		if err := s.MarkProcessed(key, 100, uid); err != nil {
+			t.Fatalf("MarkProcessed failed: %v", err)
+		}
+	}
+
+	if n := s.CheckUIDValidity(key, 100); n != 0 {
+		t.Errorf("expected no reset for unchanged UIDVALIDITY, discarded %d", n)
+	}
+	if s.IsProcessed(key, 200, 1) {
+		t.Error("expected UIDs not to match a different UIDVALIDITY")
+	}
+	if n := s.CheckUIDValidity(key, 200); n != 2 {
+		t.Errorf("expected 2 UIDs discarded, got %d", n)
+	}
+	if s.IsProcessed(key, 100, 1) {
+		t.Error("expected old UIDs to be forgotten after reset")
+	}
+}
+
+func TestLoadStateStore_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0644); err != nil {
+		t.Fatalf("writing state file: %v", err)
+	}
+	if _, err := LoadStateStore(path); err == nil {
+		t.Error("expected error for invalid state file, got nil")
+	}
+}
+
+func TestLoadStateStore_HandEdited(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	data := `{"mailboxes": {
+		"user@imap.example.com/INBOX": {"uid_validity": 1, "uids": [9, 3, 7, 3]},
+		"user@imap.example.com/Archive": null
+	}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("writing state file: %v", err)
+	}
+
+	store, err := LoadStateStore(path)
+	if err != nil {
+		t.Fatalf("LoadStateStore failed: %v", err)
+	}
+	key := "user@imap.example.com/INBOX"
+	for _, uid := range []imap.UID{3, 7, 9} {
+		if !store.IsProcessed(key, 1, uid) {
+			t.Errorf("expected UID %d to be processed", uid)
+		}
+	}
+	if err := store.MarkProcessed(key, 1, 5); err != nil {
+		t.Fatalf("MarkProcessed failed: %v", err)
+	}
+	if got := store.mailboxes[key].UIDs; !slices.Equal(got, []imap.UID{3, 5, 7, 9}) {
+		t.Errorf("expected sorted UIDs without duplicates, got %v", got)
+	}
+
+	// A null entry is treated as a mailbox with nothing processed
+	archive := "user@imap.example.com/Archive"
+	if store.IsProcessed(archive, 1, 1) {
+		t.Error("expected nothing processed in a null entry")
+	}
+	if err := store.MarkProcessed(archive, 1, 1); err != nil {
+		t.Fatalf("MarkProcessed on a null entry failed: %v", err)
+	}
+}
+
+func TestCanStoreKeyword(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []imap.Flag
+		want  bool
+	}{
+		{"wildcard", []imap.Flag{imap.FlagSeen, imap.FlagWildcard}, true},
+		{"explicit keyword", []imap.Flag{imap.FlagSeen, seenKeyword}, true},
+		{"system flags only", []imap.Flag{imap.FlagSeen, imap.FlagDeleted}, false},
+		{"read-only mailbox", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canStoreKeyword(tt.flags); got != tt.want {
+				t.Errorf("canStoreKeyword(%v) = %v, want %v", tt.flags, got, tt.want)
+			}
+		})
+	}
+}
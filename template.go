@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateData is the data available to output_template when naming a saved
+// attachment.
+type TemplateData struct {
+	UID        uint32
+	Subject    string
+	From       string
+	FromDomain string
+	Date       time.Time
+	MessageID  string
+	Filename   string
+	MIMEType   string
+	Index      int
+	Hash       string
+}
+
+// ParseOutputTemplate parses an output_template string.
+func ParseOutputTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("output").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing output_template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// newTemplateData builds the template data for an attachment whose content
+// has the given hex SHA-256 hash. Values that
+// come from the message are sanitized so they can't introduce extra path
+// components.
+func newTemplateData(msg *Message, att Attachment, filename, hash string) TemplateData {
+	td := TemplateData{
+		Filename: filename,
+		MIMEType: att.MIMEType,
+		Index:    att.Index,
+		Hash:     hash,
+	}
+	if msg != nil {
+		td.UID = uint32(msg.UID)
+		td.Subject = sanitizePathElement(msg.Subject)
+		td.From = sanitizePathElement(msg.From)
+		if _, domain, ok := strings.Cut(msg.From, "@"); ok {
+			td.FromDomain = sanitizePathElement(domain)
+		}
+		td.Date = msg.Date
+		td.MessageID = sanitizePathElement(msg.MessageID)
+	}
+	return td
+}
+
+// expandOutputPath executes tmpl and returns the resulting path relative to
+// the output directory.
+func expandOutputPath(tmpl *template.Template, td TemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, td); err != nil {
+		return "", fmt.Errorf("expanding output_template: %w", err)
+	}
+
+	// Empty values can leave a leading or doubled separator behind; the
+	// result is always relative to the output directory.
+	raw := strings.TrimLeft(strings.TrimSpace(buf.String()), "/")
+	if raw == "" || strings.HasSuffix(raw, "/") {
+		return "", errors.New("output_template expanded to an empty filename")
+	}
+	path := filepath.Clean(filepath.FromSlash(raw))
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("output_template expanded to %q, which is outside the output directory", path)
+	}
+	return path, nil
+}
+
+// sanitizePathElement replaces characters that would split a value into
+// several path components or hide the resulting file.
+func sanitizePathElement(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '_'
+		case r < 0x20 || r == 0x7f:
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.TrimLeft(strings.TrimSpace(s), ".")
+	return s
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandOutputPath(t *testing.T) {
+	msg := &Message{
+		UID:       42,
+		Subject:   "Trip / Day 1",
+		From:      "alice@example.com",
+		Date:      time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC),
+		MessageID: "abc123@example.com",
+	}
+	att := Attachment{Filename: "IMG_0001.jpg", MIMEType: "image/jpeg", Index: 2}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"filename only", "{{.Filename}}", "IMG_0001.jpg"},
+		{"date and sender", `{{.Date.Format "2006/01"}}/{{.FromDomain}}/{{.UID}}-{{.Filename}}`, "2024/03/example.com/42-IMG_0001.jpg"},
+		{"subject is sanitized", "{{.Subject}}/{{.Index}}.jpg", "Trip _ Day 1/2.jpg"},
+		{"hash prefix", `{{slice .Hash 0 8}}.jpg`, "ba7816bf.jpg"},
+		{"mime type", `{{.MIMEType}}/{{.Filename}}`, "image/jpeg/IMG_0001.jpg"},
+		{"message id", "{{.MessageID}}/{{.Filename}}", "abc123@example.com/IMG_0001.jpg"},
+		{"empty leading component", "{{if false}}x{{end}}/{{.Filename}}", "IMG_0001.jpg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseOutputTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("ParseOutputTemplate failed: %v", err)
+			}
+			got, err := expandOutputPath(tmpl, newTemplateData(msg, att, att.Filename, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"))
+			if err != nil {
+				t.Fatalf("expandOutputPath failed: %v", err)
+			}
+			if got != filepath.FromSlash(tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestExpandOutputPath_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+	}{
+		{"parent directory", "../{{.Filename}}"},
+		{"hidden traversal", "a/../../{{.Filename}}"},
+		{"empty result", "{{.Subject}}"},
+		{"trailing separator", "{{.Filename}}/"},
+		{"unknown field", "{{.Nope}}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseOutputTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("ParseOutputTemplate failed: %v", err)
+			}
+			att := Attachment{Filename: "photo.jpg", MIMEType: "image/jpeg"}
+			if got, err := expandOutputPath(tmpl, newTemplateData(&Message{}, att, att.Filename, "")); err == nil {
+				t.Errorf("expected error, got %q", got)
+			}
+		})
+	}
+}
+
+func TestParseOutputTemplate_Invalid(t *testing.T) {
+	if _, err := ParseOutputTemplate("{{.Filename"); err == nil {
+		t.Error("expected error for invalid template, got nil")
+	}
+}
+
+func TestSaveAttachment_Template(t *testing.T) {
+	tmpDir := t.TempDir()
+	tmpl, err := ParseOutputTemplate(`{{.Date.Format "2006/01"}}/{{.FromDomain}}/{{.Filename}}`)
+	if err != nil {
+		t.Fatalf("ParseOutputTemplate failed: %v", err)
+	}
+
+	msg := &Message{
+		UID:  7,
+		From: "bob@example.org",
+		Date: time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC),
+	}
+	att := Attachment{
+		Filename: "photo.jpg",
+		MIMEType: "image/jpeg",
+		Data:     bytes.NewReader([]byte("data")),
+	}
+
+	path, err := SaveAttachment(OSFileWriter{}, tmpDir, att, SaveOptions{Template: tmpl, Message: msg})
+	if err != nil {
+		t.Fatalf("SaveAttachment failed: %v", err)
+	}
+
+	expectedPath := filepath.Join(tmpDir, "2023", "12", "example.org", "photo.jpg")
+	if path != expectedPath {
+		t.Errorf("expected path %q, got %q", expectedPath, path)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// tlsVersions maps tls_min_version values to their crypto/tls constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// buildTLSConfig returns the TLS configuration for connecting to the server,
+// or nil if none of the TLS options are set and the defaults apply.
+func buildTLSConfig(cfg *Config) (*tls.Config, error) {
+	if !cfg.Insecure && cfg.TLSCAFile == "" && cfg.TLSCertFile == "" &&
+		cfg.TLSServerName == "" && cfg.TLSMinVersion == "" && len(cfg.TLSPinSHA256) == 0 {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.Insecure,
+		ServerName:         cfg.TLSServerName,
+	}
+
+	if cfg.TLSMinVersion != "" {
+		version, ok := tlsVersions[cfg.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls_min_version: %s", cfg.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading tls_ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in tls_ca_file %s", cfg.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(cfg.TLSPinSHA256) > 0 {
+		pins, err := parsePins(cfg.TLSPinSHA256)
+		if err != nil {
+			return nil, err
+		}
+		// VerifyConnection runs whether or not the chain was verified, so
+		// pinning also works together with insecure for self-signed servers
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(pinnableCertificates(cs), pins)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// parsePins decodes base64 SPKI SHA-256 pins. An optional "sha256//" prefix,
+// as used by curl's --pinnedpubkey, is accepted.
+func parsePins(values []string) ([][]byte, error) {
+	pins := make([][]byte, 0, len(values))
+	for _, v := range values {
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, "sha256//"))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid tls_pin_sha256 %q: must be a base64 SHA-256 digest", v)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// spkiHash returns the SHA-256 of a certificate's SubjectPublicKeyInfo.
+func spkiHash(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// pinnableCertificates returns the certificates a pin may match: those of
+// the verified chains, so that an intermediate or CA can be pinned, or only
+// the leaf when the chain wasn't verified. Any other certificate the server
+// sends is unchecked, and an attacker could append the real server's.
+func pinnableCertificates(cs tls.ConnectionState) []*x509.Certificate {
+	if len(cs.VerifiedChains) > 0 {
+		var certs []*x509.Certificate
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+		return certs
+	}
+	if len(cs.PeerCertificates) > 0 {
+		return cs.PeerCertificates[:1]
+	}
+	return nil
+}
+
+// verifyPins succeeds if any of certs has a public key matching one of pins.
+// The first certificate is the server's own.
+func verifyPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		hash := spkiHash(cert)
+		for _, pin := range pins {
+			if bytes.Equal(hash, pin) {
+				return nil
+			}
+		}
+	}
+	if len(certs) == 0 {
+		return errors.New("server presented no certificate to check against tls_pin_sha256")
+	}
+	return fmt.Errorf("server certificate does not match tls_pin_sha256 (server key is sha256//%s)",
+		base64.StdEncoding.EncodeToString(spkiHash(certs[0])))
+}
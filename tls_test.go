@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// testCert is a generated certificate and its key, both PEM encoded.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA
+// certificate if parent is nil.
+func newTestCert(t *testing.T, parent *testCert, name string, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		tmpl.DNSNames = []string{name}
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshaling key: %v", err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatalf("loading key pair: %v", err)
+	}
+	return cert
+}
+
+// writeTestFile writes data to name in dir and returns the path.
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("writing %s: %v", name, err)
+	}
+	return path
+}
+
+// newTestTLSServer starts an implicit-TLS test server for imap.example.com
+// and returns a config pointing at it.
+func newTestTLSServer(t *testing.T, serverTLS *tls.Config) *Config {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	serveTestIMAP(t, ln, imap.CapSet{imap.CapIMAP4rev1: {}})
+
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return &Config{
+		Server:        host,
+		Port:          port,
+		Username:      "user",
+		Password:      "pass",
+		Security:      SecurityTLS,
+		TLSServerName: "imap.example.com",
+	}
+}
+
+func TestNewMailClient_TLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, nil, "Test CA", 0)
+	server := newTestCert(t, ca, "imap.example.com", x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, ca, "mailgrab", x509.ExtKeyUsageClientAuth)
+	other := newTestCert(t, nil, "Other CA", 0)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	caFile := writeTestFile(t, dir, "ca.pem", ca.certPEM)
+	otherCAFile := writeTestFile(t, dir, "other.pem", other.certPEM)
+	certFile := writeTestFile(t, dir, "client.pem", client.certPEM)
+	keyFile := writeTestFile(t, dir, "client.key", client.keyPEM)
+
+	// An attacker's certificate for the same name, which appends the real
+	// server's certificate to its chain
+	attackerCA := newTestCert(t, nil, "Attacker CA", 0)
+	attacker := newTestCert(t, attackerCA, "imap.example.com", x509.ExtKeyUsageServerAuth)
+	attackerCAFile := writeTestFile(t, dir, "attacker.pem", attackerCA.certPEM)
+
+	serverPin := base64.StdEncoding.EncodeToString(spkiHash(server.cert))
+	otherPin := base64.StdEncoding.EncodeToString(spkiHash(other.cert))
+	caPin := base64.StdEncoding.EncodeToString(spkiHash(ca.cert))
+
+	tests := []struct {
+		name      string
+		mutualTLS bool
+		// attacker makes the server present the attacker's certificate
+		// followed by the real server's
+		attacker  bool
+		configure func(cfg *Config)
+		wantErr   string
+	}{
+		{
+			name:      "private CA",
+			configure: func(cfg *Config) { cfg.TLSCAFile = caFile },
+		},
+		{
+			name:      "wrong CA",
+			configure: func(cfg *Config) { cfg.TLSCAFile = otherCAFile },
+			wantErr:   "certificate signed by unknown authority",
+		},
+		{
+			name:      "client certificate",
+			mutualTLS: true,
+			configure: func(cfg *Config) {
+				cfg.TLSCAFile = caFile
+				cfg.TLSCertFile = certFile
+				cfg.TLSKeyFile = keyFile
+			},
+		},
+		{
+			name:      "missing client certificate",
+			mutualTLS: true,
+			configure: func(cfg *Config) { cfg.TLSCAFile = caFile },
+			wantErr:   "handshake failure",
+		},
+		{
+			name: "pinned key",
+			configure: func(cfg *Config) {
+				cfg.TLSCAFile = caFile
+				cfg.TLSPinSHA256 = []string{otherPin, "sha256//" + serverPin}
+			},
+		},
+		{
+			name: "pin mismatch",
+			configure: func(cfg *Config) {
+				cfg.TLSCAFile = caFile
+				cfg.TLSPinSHA256 = []string{otherPin}
+			},
+			wantErr: "does not match tls_pin_sha256",
+		},
+		{
+			name: "pinned CA",
+			configure: func(cfg *Config) {
+				cfg.TLSCAFile = caFile
+				cfg.TLSPinSHA256 = []string{caPin}
+			},
+		},
+		{
+			name:     "pinned key only in extra chain certificate with insecure",
+			attacker: true,
+			configure: func(cfg *Config) {
+				cfg.Insecure = true
+				cfg.TLSPinSHA256 = []string{serverPin}
+			},
+			wantErr: "does not match tls_pin_sha256",
+		},
+		{
+			name:     "pinned key only in extra chain certificate",
+			attacker: true,
+			configure: func(cfg *Config) {
+				cfg.TLSCAFile = attackerCAFile
+				cfg.TLSPinSHA256 = []string{serverPin}
+			},
+			wantErr: "does not match tls_pin_sha256",
+		},
+		{
+			name: "pinned self-signed with insecure",
+			configure: func(cfg *Config) {
+				cfg.Insecure = true
+				cfg.TLSPinSHA256 = []string{serverPin}
+			},
+		},
+		{
+			name: "minimum version not supported by server",
+			configure: func(cfg *Config) {
+				cfg.TLSCAFile = caFile
+				cfg.TLSMinVersion = "1.3"
+			},
+			wantErr: "protocol version",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverCert := server.tlsCertificate(t)
+			if tt.attacker {
+				serverCert = attacker.tlsCertificate(t)
+				serverCert.Certificate = append(serverCert.Certificate, server.cert.Raw)
+			}
+			serverTLS := &tls.Config{
+				Certificates: []tls.Certificate{serverCert},
+				MaxVersion:   tls.VersionTLS12,
+			}
+			if tt.mutualTLS {
+				serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+				serverTLS.ClientCAs = clientCAs
+			}
+			cfg := newTestTLSServer(t, serverTLS)
+			tt.configure(cfg)
+
+			m, err := NewMailClient(cfg, func(string, ...any) {})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("NewMailClient failed: %v", err)
+				}
+				_ = m.Close()
+				return
+			}
+			if err == nil {
+				_ = m.Close()
+				t.Fatalf("expected error containing %q, got nil", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %q", tt.wantErr, err.Error())
+			}
+		})
+	}
+}
+
+func TestBuildTLSConfig_Defaults(t *testing.T) {
+	tlsConfig, err := buildTLSConfig(&Config{})
+	if err != nil {
+		t.Fatalf("buildTLSConfig failed: %v", err)
+	}
+	if tlsConfig != nil {
+		t.Errorf("expected nil TLS config without TLS options, got %+v", tlsConfig)
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	if _, err := parsePins([]string{valid, "sha256//" + valid}); err != nil {
+		t.Errorf("expected valid pins, got %v", err)
+	}
+	for _, pin := range []string{"not base64!", base64.StdEncoding.EncodeToString(make([]byte, 20))} {
+		if _, err := parsePins([]string{pin}); err == nil {
+			t.Errorf("expected error for pin %q, got nil", pin)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// defaultIncludeTypes is what include_types is when it isn't set.
+var defaultIncludeTypes = []string{"image/*"}
+
+// ErrTypeNotIncluded is returned when the detected type of an attachment
+// isn't one of include_types, or is one of exclude_types.
+var ErrTypeNotIncluded = errors.New("type is not included")
+
+// TypeFilter decides which attachments are saved, and where, by their MIME
+// type or file extension. Each pattern is either a MIME type, possibly a glob
+// like image/*, or an extension like .pdf.
+type TypeFilter struct {
+	Include []string
+	Exclude []string
+	// Dirs maps patterns to subdirectories of the output directory.
+	Dirs      map[string]string
+	Detection TypeDetection
+}
+
+// typeFilter returns the TypeFilter for the include_types, exclude_types,
+// type_dirs, and type_detection settings.
+func (c *Config) typeFilter() TypeFilter {
+	return TypeFilter{
+		Include:   c.IncludeTypes,
+		Exclude:   c.ExcludeTypes,
+		Dirs:      c.TypeDirs,
+		Detection: c.TypeDetection,
+	}
+}
+
+// matchType reports whether an attachment with the given MIME type and
+// filename matches pattern.
+func matchType(pattern, mimeType, filename string) bool {
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, ".") {
+		return strings.ToLower(filepath.Ext(filename)) == pattern
+	}
+	matched, _ := path.Match(pattern, strings.ToLower(mimeType))
+	return matched
+}
+
+// matches reports whether an attachment with the given MIME type and
+// filename is included and not excluded.
+func (f TypeFilter) matches(mimeType, filename string) bool {
+	match := func(pattern string) bool { return matchType(pattern, mimeType, filename) }
+	return slices.ContainsFunc(f.Include, match) && !slices.ContainsFunc(f.Exclude, match)
+}
+
+// includesImages reports whether any image format would be saved.
+func (f TypeFilter) includesImages() bool {
+	return slices.ContainsFunc(imageTypes, func(t imageType) bool {
+		return f.matches(t.MIMEType, "file"+t.Exts[0])
+	})
+}
+
+// mayMatch reports whether att has to be downloaded to decide if it is
+// saved: it is included by its MIME type or extension or, when the content
+// decides, it may turn out to be an included image.
+func (f TypeFilter) mayMatch(att Attachment) bool {
+	if f.matches(att.MIMEType, att.Filename) {
+		return true
+	}
+	return f.Detection == TypeDetectionContent &&
+		(isGenericMIME(att.MIMEType) || hasImageExtension(att.Filename)) &&
+		f.includesImages()
+}
+
+// Candidates returns the attachments that may be saved, going by what the
+// message says about them.
+func (f TypeFilter) Candidates(attachments []Attachment) []Attachment {
+	var candidates []Attachment
+	for _, att := range attachments {
+		if f.mayMatch(att) {
+			candidates = append(candidates, att)
+		}
+	}
+	return candidates
+}
+
+// NeedsPeek reports whether att is a candidate only because its content may
+// turn out to be an included image. Its first bytes should then be checked
+// with Precheck before the whole attachment is downloaded.
+func (f TypeFilter) NeedsPeek(att Attachment) bool {
+	return f.Detection == TypeDetectionContent && !f.matches(att.MIMEType, att.Filename)
+}
+
+// Precheck checks header, the first bytes of att, as Check would, so that an
+// attachment that isn't an included image needn't be downloaded.
+func (f TypeFilter) Precheck(att Attachment, header []byte) error {
+	att.Data = bytes.NewReader(header)
+	_, err := f.Check(att)
+	return err
+}
+
+// Check decides whether a candidate attachment, whose Data must be set, is
+// saved. With the header policy, every candidate is. Otherwise its first
+// bytes are checked: an attachment that claims to be an image by its MIME
+// type or extension but isn't gets ErrNotImage, and an image whose real type
+// isn't included gets ErrTypeNotIncluded. Images of formats that aren't
+// recognized, like SVG, are trusted unless their content is certainly not an
+// image. The returned attachment has the detected MIME type and a matching
+// file extension, and reads the same data.
+func (f TypeFilter) Check(att Attachment) (Attachment, error) {
+	if f.Detection == TypeDetectionHeader {
+		return att, nil
+	}
+
+	att, header, err := peekAttachment(att)
+	if err != nil {
+		return att, err
+	}
+	t, ok := sniffImageType(header)
+	if !ok {
+		declared := IsImageMIME(att.MIMEType) || hasImageExtension(att.Filename)
+		if !f.matches(att.MIMEType, att.Filename) || declared && (recognizableImage(att.MIMEType, att.Filename) || sniffNotImage(header)) {
+			return att, fmt.Errorf("%w (declared as %s)", ErrNotImage, att.MIMEType)
+		}
+		return att, nil
+	}
+
+	att.MIMEType = t.MIMEType
+	att.Filename = fixExtension(att.Filename, t)
+	if !f.matches(att.MIMEType, att.Filename) {
+		return att, fmt.Errorf("%w: %s", ErrTypeNotIncluded, att.MIMEType)
+	}
+	return att, nil
+}
+
+// Dir returns the subdirectory of the output directory to save att in, or
+// "" for the output directory itself. Extensions and exact MIME types take
+// precedence over globs.
+func (f TypeFilter) Dir(att Attachment) string {
+	patterns := slices.Sorted(maps.Keys(f.Dirs))
+	slices.SortStableFunc(patterns, func(a, b string) int {
+		switch ga, gb := isTypeGlob(a), isTypeGlob(b); {
+		case ga == gb:
+			return 0
+		case ga:
+			return 1
+		default:
+			return -1
+		}
+	})
+	for _, pattern := range patterns {
+		if matchType(pattern, att.MIMEType, att.Filename) {
+			return f.Dirs[pattern]
+		}
+	}
+	return ""
+}
+
+func isTypeGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// validateTypePatterns checks the patterns of the setting called name.
+func validateTypePatterns(name string, patterns []string) error {
+	for _, pattern := range patterns {
+		if err := validateTypePattern(pattern); err != nil {
+			return fmt.Errorf("invalid pattern in %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func validateTypePattern(pattern string) error {
+	if strings.HasPrefix(pattern, ".") {
+		if len(pattern) == 1 || strings.ContainsAny(pattern, "/*?[") {
+			return fmt.Errorf("%q is not a file extension", pattern)
+		}
+		return nil
+	}
+	if !strings.Contains(pattern, "/") {
+		return fmt.Errorf("%q is neither a MIME type nor an extension starting with a dot", pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("%q is not a valid glob", pattern)
+	}
+	return nil
+}
+
+// validateTypeDirs checks the type_dirs setting.
+func validateTypeDirs(dirs map[string]string) error {
+	for pattern, dir := range dirs {
+		if err := validateTypePattern(pattern); err != nil {
+			return fmt.Errorf("invalid pattern in type_dirs: %w", err)
+		}
+		if !filepath.IsLocal(dir) {
+			return fmt.Errorf("type_dirs entry %s must be a relative path inside the output directory, got %q", pattern, dir)
+		}
+	}
+	return nil
+}
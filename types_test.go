@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestMatchType(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		mimeType string
+		filename string
+		want     bool
+	}{
+		{"image/*", "image/jpeg", "photo.jpg", true},
+		{"image/*", "IMAGE/PNG", "photo.png", true},
+		{"image/*", "application/pdf", "photo.jpg", false},
+		{"application/pdf", "application/pdf", "scan", true},
+		{"application/pdf", "application/pdf-x", "scan", false},
+		{".pdf", "application/octet-stream", "scan.PDF", true},
+		{".pdf", "application/pdf", "scan", false},
+		{".csv", "text/plain", "data.csv.txt", false},
+	}
+	for _, tt := range tests {
+		if got := matchType(tt.pattern, tt.mimeType, tt.filename); got != tt.want {
+			t.Errorf("matchType(%q, %q, %q) = %v, want %v", tt.pattern, tt.mimeType, tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestTypeFilterCandidates(t *testing.T) {
+	attachments := []Attachment{
+		{Filename: "photo.jpg", MIMEType: "image/jpeg"},
+		{Filename: "IMG_0001", MIMEType: "application/octet-stream"},
+		{Filename: "IMG_0002.HEIC", MIMEType: "application/x-unknown"},
+		{Filename: "report.pdf", MIMEType: "application/pdf"},
+		{Filename: "data.csv", MIMEType: "application/octet-stream"},
+		{Filename: "notes.txt", MIMEType: "text/plain"},
+		{Filename: "icon.gif", MIMEType: "image/gif"},
+	}
+
+	tests := []struct {
+		name   string
+		filter TypeFilter
+		want   []string
+	}{
+		{"header", TypeFilter{Include: defaultIncludeTypes, Detection: TypeDetectionHeader}, []string{"photo.jpg", "icon.gif"}},
+		{"both", TypeFilter{Include: defaultIncludeTypes, Detection: TypeDetectionBoth}, []string{"photo.jpg", "icon.gif"}},
+		{"content", TypeFilter{Include: defaultIncludeTypes, Detection: TypeDetectionContent}, []string{"photo.jpg", "IMG_0001", "IMG_0002.HEIC", "data.csv", "icon.gif"}},
+		{"documents", TypeFilter{Include: []string{"application/pdf", ".csv"}, Detection: TypeDetectionContent}, []string{"report.pdf", "data.csv"}},
+		{"exclude", TypeFilter{Include: []string{"image/*", "application/pdf"}, Exclude: []string{"image/gif"}, Detection: TypeDetectionHeader}, []string{"photo.jpg", "report.pdf"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, att := range tt.filter.Candidates(attachments) {
+			got = append(got, att.Filename)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+
+	if got := (TypeFilter{Include: defaultIncludeTypes}).Candidates(nil); got != nil {
+		t.Errorf("expected nil for no attachments, got %v", got)
+	}
+}
+
+func TestTypeFilterCheck(t *testing.T) {
+	filter := TypeFilter{Include: []string{"image/*", "application/pdf"}, Exclude: []string{"image/gif"}, Detection: TypeDetectionContent}
+
+	// Content that isn't an image is trusted when it doesn't claim to be one
+	att := Attachment{Filename: "report.pdf", MIMEType: "application/pdf", Data: strings.NewReader("%PDF-1.7")}
+	if got, err := filter.Check(att); err != nil || got.Filename != "report.pdf" {
+		t.Errorf("expected the PDF to be saved as is, got %+v, %v", got, err)
+	}
+
+	att = Attachment{Filename: "IMG_0001", MIMEType: "application/octet-stream", Data: strings.NewReader("MZ\x90\x00")}
+	if _, err := filter.Check(att); !errors.Is(err, ErrNotImage) {
+		t.Errorf("expected ErrNotImage for an untyped executable, got %v", err)
+	}
+
+	// An image is checked again by its real type
+	att = Attachment{Filename: "photo.jpg", MIMEType: "image/jpeg", Data: strings.NewReader("GIF89a")}
+	if got, err := filter.Check(att); !errors.Is(err, ErrTypeNotIncluded) {
+		t.Errorf("expected ErrTypeNotIncluded for an excluded GIF, got %+v, %v", got, err)
+	}
+}
+
+func TestTypeFilterDir(t *testing.T) {
+	filter := TypeFilter{Dirs: map[string]string{
+		"image/*":         "photos",
+		"image/png":       "screenshots",
+		"application/pdf": "documents",
+		".csv":            "data",
+	}}
+
+	tests := []struct {
+		att  Attachment
+		want string
+	}{
+		{Attachment{Filename: "photo.jpg", MIMEType: "image/jpeg"}, "photos"},
+		{Attachment{Filename: "screen.png", MIMEType: "image/png"}, "screenshots"},
+		{Attachment{Filename: "scan.pdf", MIMEType: "application/pdf"}, "documents"},
+		{Attachment{Filename: "export.csv", MIMEType: "text/plain"}, "data"},
+		{Attachment{Filename: "notes.txt", MIMEType: "text/plain"}, ""},
+	}
+	for _, tt := range tests {
+		if got := filter.Dir(tt.att); got != tt.want {
+			t.Errorf("Dir(%s) = %q, want %q", tt.att.Filename, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTypePatterns(t *testing.T) {
+	if err := validateTypePatterns("include_types", []string{"image/*", "application/pdf", ".csv"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, pattern := range []string{"pdf", ".", ".p*f", "image/[", ""} {
+		if err := validateTypePatterns("include_types", []string{pattern}); err == nil || !strings.Contains(err.Error(), "invalid pattern in include_types") {
+			t.Errorf("%q: expected an invalid pattern error, got %v", pattern, err)
+		}
+	}
+
+	if err := validateTypeDirs(map[string]string{"image/*": "photos/2024"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, dir := range []string{"../photos", "/tmp/photos", ""} {
+		if err := validateTypeDirs(map[string]string{"image/*": dir}); err == nil {
+			t.Errorf("%q: expected an error for a directory outside the output directory, got nil", dir)
+		}
+	}
+}
+
+func TestProcessNewMessages_TypeDirs(t *testing.T) {
+	addr, user := newTestServer(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+	pdf := strings.Replace(testImageMessage("scan.pdf", []byte("%PDF-1.7")), "image/jpeg", "application/pdf", 1)
+	appendTestMessage(t, user, "INBOX", pdf)
+	appendTestMessage(t, user, "INBOX", testImageMessage("photo.jpg", []byte("\xff\xd8\xff\xe0")))
+	appendTestMessage(t, user, "INBOX", testImageMessage("icon.gif", []byte("GIF89a")))
+
+	cfg := newTestConfig(t, addr)
+	cfg.IncludeTypes = []string{"image/*", "application/pdf"}
+	cfg.ExcludeTypes = []string{"image/gif"}
+	cfg.TypeDirs = map[string]string{"application/pdf": "documents"}
+
+	stats, code := runOnce(context.Background(), cfg, func(string, ...any) {})
+	if code != exitOK {
+		t.Fatalf("runOnce returned %d, want %d", code, exitOK)
+	}
+	if stats.Messages != 3 || stats.Saved != 2 {
+		t.Errorf("expected 3 messages and 2 files, got %+v", stats)
+	}
+
+	for _, path := range []string{"documents/scan.pdf", "photo.jpg"} {
+		if _, err := os.Stat(filepath.Join(cfg.Output, path)); err != nil {
+			t.Errorf("expected %s to be saved: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Output, "icon.gif")); !os.IsNotExist(err) {
+		t.Errorf("expected the excluded GIF not to be saved, got %v", err)
+	}
+}